@@ -15,9 +15,13 @@
 package art
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -27,239 +31,1827 @@ import (
 	"android/soong/apex"
 	"android/soong/cc"
 	"android/soong/cc/config"
+	"android/soong/etc"
 )
 
 var supportedArches = []string{"arm", "arm64", "riscv64", "x86", "x86_64"}
 
-func globalFlags(ctx android.LoadHookContext) ([]string, []string) {
-	var cflags []string
-	var asflags []string
+// SupportedArches returns the arches that ART can be built for.
+func SupportedArches() []string {
+	return android.CopyOf(supportedArches)
+}
+
+// GC types that can be selected with ART_DEFAULT_GC_TYPE, see
+// runtime/gc/collector_type.h. GENCMC is a placeholder for the generational
+// CMC prototype, see GenerationalCmcPlaceholder.
+var supportedGcTypes = []string{"CMC", "CMS", "GENCMC", "SS"}
+
+// ISAs that host builds can simulate, see art/simulator.
+var supportedSimulatorIsas = []string{"arm64"}
+
+var supportedSanitizeCoverageModes = []string{
+	"inline-8bit-counters",
+	"inline-bool-flag",
+	"trace-cmp",
+	"trace-pc",
+	"trace-pc-guard",
+}
+
+var isaFeaturesRegexp = regexp.MustCompile(`^[A-Za-z0-9_.,+-]+$`)
+
+// Instruction set features that can be selected with ART_<ARCH>_FEATURES, named
+// as in runtime/arch/<arch>/instruction_set_features_<arch>.cc.
+var supportedIsaFeatures = map[string][]string{
+	"arm64":  {"crc", "dotprod", "fp16", "lse", "sve"},
+	"x86":    {"avx", "avx2", "popcnt", "sse4.1", "sse4.2", "ssse3"},
+	"x86_64": {"avx", "avx2", "popcnt", "sse4.1", "sse4.2", "ssse3"},
+}
+
+// Warning names as used in -W<name>, e.g. unused-variable.
+var warningNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+=-]*$`)
+
+// Environment defaults for each ART_BUILD_PROFILE. Values set explicitly in the
+// environment take precedence.
+var buildProfiles = map[string]map[string]string{
+	// Release optimizations with frame pointers for profiling, and the
+	// concurrent mark-compact GC. Sanitizers are not allowed.
+	"benchmark": {
+		"ART_NDEBUG_OPT_FLAG":     "-O3",
+		"ART_DEFAULT_GC_TYPE":     "CMC",
+		"ART_KEEP_FRAME_POINTERS": "true",
+	},
+}
+
+// Returns the selected ART_BUILD_PROFILE, or "" if none is selected.
+func buildProfile(ctx android.LoadHookContext) string {
+	profile := ctx.Config().Getenv("ART_BUILD_PROFILE")
+	if _, ok := buildProfiles[profile]; profile != "" && !ok {
+		ctx.ModuleErrorf("Unknown ART_BUILD_PROFILE %q, expected one of %s",
+			profile, strings.Join(android.SortedKeys(buildProfiles), ", "))
+		return ""
+	}
+	return profile
+}
+
+// Like GetenvWithDefault, but falls back to the default of the selected build
+// profile before def.
+func getenvWithProfileDefault(ctx android.LoadHookContext, key, def string) string {
+	if value, ok := buildProfiles[ctx.Config().Getenv("ART_BUILD_PROFILE")][key]; ok {
+		def = value
+	}
+	return ctx.Config().GetenvWithDefault(key, def)
+}
+
+// Like IsEnvTrue, but falls back to the default of the selected build profile
+// when the variable is unset.
+func isEnvTrueWithProfileDefault(ctx android.LoadHookContext, key string) bool {
+	if set, value := envTristate(ctx, key); set {
+		return value
+	}
+	return buildProfiles[ctx.Config().Getenv("ART_BUILD_PROFILE")][key] == "true"
+}
+
+// The effective ART build configuration, as resolved from the environment by
+// artBuildConfig. The flag functions below only derive flags from it.
+type ArtConfig struct {
+	// The selected ART_BUILD_PROFILE, or empty.
+	BuildProfile string `json:"build_profile"`
+
+	KeepFramePointers bool `json:"keep_frame_pointers"`
+	// ART_NDEBUG_OPT_FLAG, and its per-target overrides. The overrides are empty
+	// when not set.
+	OptFlag       string `json:"opt_flag"`
+	DeviceOptFlag string `json:"device_opt_flag"`
+	HostOptFlag   string `json:"host_opt_flag"`
+
+	GcType          string `json:"gc_type"`
+	Tlab            bool   `json:"tlab"`
+	HeapPoisoning   bool   `json:"heap_poisoning"`
+	CxxInterpreter  bool   `json:"cxx_interpreter"`
+	InterpreterOnly bool   `json:"interpreter_only"`
+
+	ReadBarrier     bool   `json:"read_barrier"`
+	ReadBarrierType string `json:"read_barrier_type"`
+	// Whether ART_USE_READ_BARRIER was set to true explicitly.
+	ForceReadBarrier bool `json:"force_read_barrier"`
+	// Generational CC, only used with read barriers.
+	Generational bool `json:"generational"`
+	// Whether Generational was not selected explicitly, but implied by
+	// ForceReadBarrier.
+	GenerationalImpliedByRb bool `json:"generational_implied_by_rb"`
+	// Whether ART_USE_GENERATIONAL_GC=1 is defined for GENCMC, or for CMC with
+	// ART_USE_GENERATIONAL_GC=true. This is only a placeholder for the
+	// generational CMC prototype: no runtime code reads the define yet, so the
+	// runtime still collects with the non-generational CMC.
+	GenerationalCmcPlaceholder bool `json:"generational_cmc_placeholder"`
+
+	CompactDexLevel string `json:"compact_dex_level"`
+
+	// Whether host tools run generated code in a simulator of SimulatorIsa.
+	Simulator    bool   `json:"simulator"`
+	SimulatorIsa string `json:"simulator_isa"`
+
+	// The sanitizers of each target, from SANITIZE_TARGET and SANITIZE_HOST, and
+	// the extra sanitizers.
+	DeviceSanitizers []string `json:"device_sanitizers"`
+	HostSanitizers   []string `json:"host_sanitizers"`
+	// The sanitizers that ART_EXTRA_SANITIZERS enables on each target, as
+	// selected by ART_EXTRA_SANITIZERS_VARIANT.
+	DeviceExtraSanitizers []string `json:"device_extra_sanitizers"`
+	HostExtraSanitizers   []string `json:"host_extra_sanitizers"`
+	// Whether ART_ENABLE_ADDRESS_SANITIZER is defined, which enables full
+	// sanitization, i.e., user poisoning, under ASAN.
+	DeviceAddressSanitizer bool `json:"device_address_sanitizer"`
+	HostAddressSanitizer   bool `json:"host_address_sanitizer"`
+
+	DeviceFrameSizeLimit int `json:"device_frame_size_limit"`
+	HostFrameSizeLimit   int `json:"host_frame_size_limit"`
+	// Whether frames above the limits are errors rather than warnings.
+	FrameSizeError bool `json:"frame_size_error"`
+	// The stack overflow gap of each arch, shared by host and device.
+	StackOverflowGaps map[string]int `json:"stack_overflow_gaps"`
+
+	// Optional settings, which are empty or zero when not set.
+	VerifyLevel          string `json:"verify_level"`
+	NativeAllocator      string `json:"native_allocator"`
+	SanitizeCoverage     string `json:"sanitize_coverage"`
+	LargeObjectThreshold int    `json:"large_object_threshold"`
+	GcThreadCount        int    `json:"gc_thread_count"`
+	// The LLVM inline threshold, or nil for the default.
+	InlineThreshold    *int   `json:"inline_threshold"`
+	DefaultIsaFeatures string `json:"default_isa_features"`
+	// The instruction set features from ART_<ARCH>_FEATURES, keyed by arch.
+	IsaFeatures map[string][]string `json:"isa_features"`
+
+	// Whether ART_USE_D8_DESUGAR is set, and whether desugaring is on.
+	D8DesugarOverridden bool `json:"d8_desugar_overridden"`
+	UseD8Desugar        bool `json:"use_d8_desugar"`
+	// See forceAssertsMode.
+	ForceAsserts string `json:"force_asserts"`
+
+	// "thin" or "full" when building with LTO, or empty.
+	Lto string `json:"lto"`
+	// The profile to optimize with, from ART_PGO_PROFILE.
+	PgoProfile string `json:"pgo_profile"`
+
+	// Identifies the flag-affecting environment, see artEnvHash.
+	ConfigHash string `json:"config_hash"`
+}
 
-	opt := ctx.Config().GetenvWithDefault("ART_NDEBUG_OPT_FLAG", "-O3")
-	cflags = append(cflags, opt)
+// Resolves the ART build configuration from the environment, and reports
+// errors for invalid values.
+func artBuildConfig(ctx android.LoadHookContext) ArtConfig {
+	var c ArtConfig
 
-	tlab := false
-	gcType := ctx.Config().GetenvWithDefault("ART_DEFAULT_GC_TYPE", "CMC")
+	c.BuildProfile = buildProfile(ctx)
+	c.KeepFramePointers = isEnvTrueWithProfileDefault(ctx, "ART_KEEP_FRAME_POINTERS")
+	c.OptFlag = getenvWithProfileDefault(ctx, "ART_NDEBUG_OPT_FLAG", "-O3")
+	c.DeviceOptFlag = ctx.Config().Getenv("ART_NDEBUG_OPT_FLAG_DEVICE")
+	c.HostOptFlag = ctx.Config().Getenv("ART_NDEBUG_OPT_FLAG_HOST")
 
+	c.GcType = getenvWithProfileDefault(ctx, "ART_DEFAULT_GC_TYPE", "CMC")
 	if ctx.Config().IsEnvTrue("ART_TEST_DEBUG_GC") {
-		gcType = "SS"
-		tlab = true
+		c.GcType = "SS"
+		c.Tlab = true
+	} else if !android.InList(c.GcType, supportedGcTypes) {
+		// Only check values that are not overridden above.
+		ctx.ModuleErrorf("Unknown ART_DEFAULT_GC_TYPE %q, expected one of %s",
+			c.GcType, strings.Join(supportedGcTypes, ", "))
+	}
+
+	c.HeapPoisoning = ctx.Config().IsEnvTrue("ART_HEAP_POISONING")
+	c.CxxInterpreter = ctx.Config().IsEnvTrue("ART_USE_CXX_INTERPRETER")
+	c.InterpreterOnly = ctx.Config().IsEnvTrue("ART_INTERPRETER_ONLY")
+
+	// ART_USE_GENERATIONAL_GC replaces ART_USE_GENERATIONAL_CC, which is still
+	// honored when the new name is not set. Resolved for all GC types, so that
+	// the deprecation warning does not depend on the read barrier configuration.
+	generationalSet, generational := resolveAliasedEnv(ctx, "ART_USE_GENERATIONAL_GC", "ART_USE_GENERATIONAL_CC")
+	readBarrierSet, readBarrier := envTristate(ctx, "ART_USE_READ_BARRIER")
+	if (!readBarrierSet || readBarrier) && ctx.Config().ArtUseReadBarrier() {
+		c.ReadBarrier = true
+		// Used to change the read barrier type. Valid values are BAKER, TABLELOOKUP.
+		// The default is BAKER.
+		c.ReadBarrierType = ctx.Config().GetenvWithDefault("ART_READ_BARRIER_TYPE", "BAKER")
+		if c.ReadBarrierType != "BAKER" && c.ReadBarrierType != "TABLELOOKUP" {
+			ctx.ModuleErrorf("Unknown ART_READ_BARRIER_TYPE %q, expected one of BAKER, TABLELOOKUP", c.ReadBarrierType)
+		}
+		c.Generational = !generationalSet || generational
+		// Force CC only if ART_USE_READ_BARRIER was set to true explicitly during
+		// build time.
+		c.ForceReadBarrier = readBarrierSet && readBarrier
+		c.GenerationalImpliedByRb = c.ForceReadBarrier && !generationalSet
+		// Forcing read barriers disables userfaultfd, see read_barrier_config.h.
+		// Check the resolved GC type, which is CMC by default and in the build
+		// profiles as well.
+		if c.ForceReadBarrier && (c.GcType == "CMC" || c.GcType == "GENCMC") {
+			ctx.ModuleErrorf("ART_DEFAULT_GC_TYPE=%s cannot be used with ART_USE_READ_BARRIER=true", c.GcType)
+		}
+		c.Tlab = true
+	} else if c.GcType == "CMC" || c.GcType == "GENCMC" {
+		c.Tlab = true
+	}
+
+	// Without read barriers, CMC is marked generational when
+	// ART_USE_GENERATIONAL_GC is true, and GENCMC always is. See
+	// GenerationalCmcPlaceholder.
+	if c.GcType == "CMC" && !c.ReadBarrier {
+		c.GenerationalCmcPlaceholder = generationalSet && generational
+	}
+	if c.GcType == "GENCMC" {
+		if generationalSet && !generational {
+			ctx.ModuleErrorf("ART_DEFAULT_GC_TYPE=GENCMC cannot be used with ART_USE_GENERATIONAL_GC=false")
+		}
+		c.GenerationalCmcPlaceholder = !c.ReadBarrier
+	}
+
+	// Heap poisoning is not a supported configuration of the generational CMC
+	// GC. Only warn, since it still builds.
+	if c.HeapPoisoning && c.GenerationalCmcPlaceholder {
+		log.Print("Warning: ART_HEAP_POISONING is not supported with the generational CMC GC, " +
+			"use it with ART_USE_GENERATIONAL_GC=false or with read barriers")
+	}
+
+	c.CompactDexLevel = ctx.Config().GetenvWithDefault("ART_DEFAULT_COMPACT_DEX_LEVEL", "fast")
+
+	if ctx.Config().IsEnvTrue("ART_USE_SIMULATOR") {
+		c.Simulator = true
+		c.SimulatorIsa = ctx.Config().GetenvWithDefault("ART_SIMULATOR_TARGET_ISA", "arm64")
+		if !android.InList(c.SimulatorIsa, supportedSimulatorIsas) {
+			ctx.ModuleErrorf("Unknown ART_SIMULATOR_TARGET_ISA %q, expected one of %s",
+				c.SimulatorIsa, strings.Join(supportedSimulatorIsas, ", "))
+		}
+	}
+
+	c.DeviceExtraSanitizers, c.HostExtraSanitizers = extraSanitizers(ctx)
+	c.DeviceSanitizers = android.FirstUniqueStrings(
+		append(android.CopyOf(ctx.Config().SanitizeDevice()), c.DeviceExtraSanitizers...))
+	c.HostSanitizers = android.FirstUniqueStrings(
+		append(android.CopyOf(ctx.Config().SanitizeHost()), c.HostExtraSanitizers...))
+	if len(c.DeviceExtraSanitizers) > 0 {
+		checkSanitizerCombination(ctx, "device", c.DeviceSanitizers)
+	}
+	if len(c.HostExtraSanitizers) > 0 {
+		checkSanitizerCombination(ctx, "host", c.HostSanitizers)
+	}
+	// Sanitizers distort the results of benchmarks.
+	if c.BuildProfile == "benchmark" && (len(c.DeviceSanitizers) > 0 || len(c.HostSanitizers) > 0) {
+		ctx.ModuleErrorf("Sanitizers cannot be enabled in the ART benchmark build profile, got %s",
+			strings.Join(android.FirstUniqueStrings(append(android.CopyOf(c.DeviceSanitizers), c.HostSanitizers...)), ", "))
+	}
+	c.DeviceAddressSanitizer, c.HostAddressSanitizer = addressSanitizerDefines(ctx, len(c.HostSanitizers) > 0)
+	c.DeviceFrameSizeLimit = deviceFrameSizeLimit(ctx, c.DeviceSanitizers)
+	c.HostFrameSizeLimit = hostFrameSizeLimit(c.HostSanitizers)
+	// Allow adjusting the limits, e.g. when a new clang inflates sanitized frames.
+	if limit, ok := getenvPositiveInt(ctx, "ART_DEVICE_FRAME_SIZE_LIMIT"); ok {
+		c.DeviceFrameSizeLimit = limit
+	}
+	if limit, ok := getenvPositiveInt(ctx, "ART_HOST_FRAME_SIZE_LIMIT"); ok {
+		c.HostFrameSizeLimit = limit
+	}
+	c.FrameSizeError = ctx.Config().IsEnvTrue("ART_FRAME_SIZE_ERROR")
+	c.StackOverflowGaps = stackOverflowGaps(ctx, len(c.DeviceSanitizers) > 0 || len(c.HostSanitizers) > 0)
+	checkFrameSizeLimits(ctx, c)
+
+	c.VerifyLevel = ctx.Config().Getenv("ART_DEFAULT_VERIFY_LEVEL")
+	switch c.VerifyLevel {
+	case "", "none", "softfail", "full":
+	default:
+		ctx.ModuleErrorf("Unknown ART_DEFAULT_VERIFY_LEVEL %q, expected one of none, softfail or full", c.VerifyLevel)
+		c.VerifyLevel = ""
+	}
+
+	// Used to experiment with native allocators other than the platform default.
+	c.NativeAllocator = ctx.Config().Getenv("ART_NATIVE_ALLOCATOR")
+	switch c.NativeAllocator {
+	case "", "jemalloc", "scudo":
+	default:
+		ctx.ModuleErrorf("Unknown ART_NATIVE_ALLOCATOR %q, expected one of jemalloc or scudo", c.NativeAllocator)
+		c.NativeAllocator = ""
+	}
+
+	c.SanitizeCoverage = ctx.Config().Getenv("ART_SANITIZE_COVERAGE")
+	if c.SanitizeCoverage != "" && !android.InList(c.SanitizeCoverage, supportedSanitizeCoverageModes) {
+		ctx.ModuleErrorf("Unknown ART_SANITIZE_COVERAGE %q, expected one of %s",
+			c.SanitizeCoverage, strings.Join(supportedSanitizeCoverageModes, ", "))
+		c.SanitizeCoverage = ""
+	}
+
+	// Objects at least this large are allocated in the large object space. Only
+	// has an effect with GCs that use a large object space.
+	c.LargeObjectThreshold, _ = getenvPositiveInt(ctx, "ART_LARGE_OBJECT_THRESHOLD")
+	// Default number of parallel GC threads. The runtime picks one based on the
+	// number of cores when this is not set.
+	c.GcThreadCount, _ = getenvPositiveInt(ctx, "ART_GC_THREAD_COUNT")
+
+	if threshold := ctx.Config().Getenv("ART_INLINE_THRESHOLD"); threshold != "" {
+		if n, err := strconv.Atoi(threshold); err != nil || n < 0 {
+			ctx.ModuleErrorf("ART_INLINE_THRESHOLD must be a non-negative integer, got %q", threshold)
+		} else {
+			c.InlineThreshold = &n
+		}
+	}
+
+	// Only check that the value can be embedded in a string literal, the feature
+	// names themselves are checked by the runtime.
+	c.DefaultIsaFeatures = ctx.Config().Getenv("ART_DEFAULT_ISA_FEATURES")
+	if c.DefaultIsaFeatures != "" && !isaFeaturesRegexp.MatchString(c.DefaultIsaFeatures) {
+		ctx.ModuleErrorf("Invalid ART_DEFAULT_ISA_FEATURES %q", c.DefaultIsaFeatures)
+		c.DefaultIsaFeatures = ""
+	}
+	c.IsaFeatures = make(map[string][]string)
+	for _, arch := range SupportedArches() {
+		if features := isaFeatures(ctx, arch); len(features) > 0 {
+			c.IsaFeatures[arch] = features
+		}
+	}
+
+	c.D8DesugarOverridden = ctx.Config().Getenv("ART_USE_D8_DESUGAR") != ""
+	c.UseD8Desugar = useD8Desugar(ctx)
+	c.ForceAsserts = forceAssertsMode(ctx)
+
+	c.Lto = ltoMode(ctx, c)
+	c.PgoProfile = pgoProfile(ctx)
+
+	c.ConfigHash = artEnvHash(ctx.Config())
+
+	return c
+}
+
+// Returns the lowercase name of the read barrier type, e.g. "baker", or "none"
+// without read barriers.
+func (c ArtConfig) readBarrierTypeName() string {
+	if !c.ReadBarrier {
+		return "none"
+	}
+	return strings.ToLower(c.ReadBarrierType)
+}
+
+// Returns the combined read barrier and generational configuration, e.g.
+// "baker+gen". The generational CMC placeholder is not reported as generational.
+func (c ArtConfig) rbGenConfig() string {
+	rbGen := c.readBarrierTypeName()
+	if c.Generational {
+		rbGen += "+gen"
+	}
+	return rbGen
+}
+
+func globalFlags(c ArtConfig) ([]string, []string) {
+	var cflags []string
+	var asflags []string
+
+	// Keep frame pointers for readable stacks when profiling, on host and device.
+	if c.KeepFramePointers {
+		cflags = append(cflags, "-fno-omit-frame-pointer")
 	}
 
-	cflags = append(cflags, "-DART_DEFAULT_GC_TYPE_IS_"+gcType)
+	cflags = append(cflags, c.OptFlag)
+
+	if c.GcType == "GENCMC" {
+		// The runtime still uses CMC as the default collector.
+		cflags = append(cflags, "-DART_DEFAULT_GC_TYPE_IS_CMC")
+	}
+	cflags = append(cflags, "-DART_DEFAULT_GC_TYPE_IS_"+c.GcType)
 
-	if ctx.Config().IsEnvTrue("ART_HEAP_POISONING") {
+	if c.HeapPoisoning {
 		cflags = append(cflags, "-DART_HEAP_POISONING=1")
 		asflags = append(asflags, "-DART_HEAP_POISONING=1")
 	}
-	if ctx.Config().IsEnvTrue("ART_USE_CXX_INTERPRETER") {
+	if c.CxxInterpreter {
 		cflags = append(cflags, "-DART_USE_CXX_INTERPRETER=1")
+		cflags = append(cflags, "-DART_CXX_INTERPRETER_ENABLED=1")
+	} else {
+		cflags = append(cflags, "-DART_CXX_INTERPRETER_ENABLED=0")
+	}
+	if c.InterpreterOnly {
+		// No optimizing backends are selected by the codegen customizer.
+		cflags = append(cflags, "-DART_INTERPRETER_ONLY=1")
 	}
 
-	if !ctx.Config().IsEnvFalse("ART_USE_READ_BARRIER") && ctx.Config().ArtUseReadBarrier() {
-		// Used to change the read barrier type. Valid values are BAKER, TABLELOOKUP.
-		// The default is BAKER.
-		barrierType := ctx.Config().GetenvWithDefault("ART_READ_BARRIER_TYPE", "BAKER")
+	if c.ReadBarrier {
 		cflags = append(cflags,
 			"-DART_USE_READ_BARRIER=1",
-			"-DART_READ_BARRIER_TYPE_IS_"+barrierType+"=1")
+			"-DART_READ_BARRIER_TYPE_IS_"+c.ReadBarrierType+"=1")
 		asflags = append(asflags,
 			"-DART_USE_READ_BARRIER=1",
-			"-DART_READ_BARRIER_TYPE_IS_"+barrierType+"=1")
+			"-DART_READ_BARRIER_TYPE_IS_"+c.ReadBarrierType+"=1")
 
-		if !ctx.Config().IsEnvFalse("ART_USE_GENERATIONAL_CC") {
+		if c.Generational {
 			cflags = append(cflags, "-DART_USE_GENERATIONAL_CC=1")
 		}
-		// Force CC only if ART_USE_READ_BARRIER was set to true explicitly during
-		// build time.
-		if ctx.Config().IsEnvTrue("ART_USE_READ_BARRIER") {
+		if c.ForceReadBarrier {
 			cflags = append(cflags, "-DART_FORCE_USE_READ_BARRIER=1")
 		}
-		tlab = true
-	} else if gcType == "CMC" {
-		tlab = true
+	} else if c.GenerationalCmcPlaceholder {
+		// Not read by the runtime yet, see GenerationalCmcPlaceholder.
+		cflags = append(cflags, "-DART_USE_GENERATIONAL_GC=1")
+	}
+
+	cflags = append(cflags, fmt.Sprintf("-DART_RB_GEN_CONFIG=\"%s\"", c.rbGenConfig()))
+	cflags = append(cflags, fmt.Sprintf("-DART_READ_BARRIER_TYPE_NAME=\"%s\"", c.readBarrierTypeName()))
+	if c.GenerationalImpliedByRb {
+		cflags = append(cflags, "-DART_GENERATIONAL_IMPLIED_BY_RB=1")
+	} else {
+		cflags = append(cflags, "-DART_GENERATIONAL_IMPLIED_BY_RB=0")
 	}
 
-	if tlab {
+	if c.Tlab {
 		cflags = append(cflags, "-DART_USE_TLAB=1")
 	}
 
-	cdexLevel := ctx.Config().GetenvWithDefault("ART_DEFAULT_COMPACT_DEX_LEVEL", "fast")
-	cflags = append(cflags, "-DART_DEFAULT_COMPACT_DEX_LEVEL="+cdexLevel)
+	cflags = append(cflags, "-DART_DEFAULT_COMPACT_DEX_LEVEL="+c.CompactDexLevel)
 
-	// We need larger stack overflow guards for ASAN, as the compiled code will have
-	// larger frame sizes. For simplicity, just use global not-target-specific cflags.
-	// Note: We increase this for both debug and non-debug, as the overflow gap will
-	//       be compiled into managed code. We always preopt (and build core images) with
-	//       the debug version. So make the gap consistent (and adjust for the worst).
-	if len(ctx.Config().SanitizeDevice()) > 0 || len(ctx.Config().SanitizeHost()) > 0 {
-		cflags = append(cflags,
-			"-DART_STACK_OVERFLOW_GAP_arm=16384",
-			"-DART_STACK_OVERFLOW_GAP_arm64=16384",
-			"-DART_STACK_OVERFLOW_GAP_riscv64=16384",
-			"-DART_STACK_OVERFLOW_GAP_x86=16384",
-			"-DART_STACK_OVERFLOW_GAP_x86_64=20480")
-	} else {
+	// Pins the default class verification level of the runtime.
+	if c.VerifyLevel != "" {
+		cflags = append(cflags, "-DART_DEFAULT_VERIFY_LEVEL_IS_"+strings.ToUpper(c.VerifyLevel)+"=1")
+	}
+
+	if c.NativeAllocator != "" {
+		cflags = append(cflags, "-DART_NATIVE_ALLOCATOR_IS_"+strings.ToUpper(c.NativeAllocator)+"=1")
+	}
+
+	// Instrument ART with SanitizerCoverage, and tell the code which mode is used.
+	if c.SanitizeCoverage != "" {
 		cflags = append(cflags,
-			"-DART_STACK_OVERFLOW_GAP_arm=8192",
-			"-DART_STACK_OVERFLOW_GAP_arm64=8192",
-			"-DART_STACK_OVERFLOW_GAP_riscv64=8192",
-			"-DART_STACK_OVERFLOW_GAP_x86=8192",
-			"-DART_STACK_OVERFLOW_GAP_x86_64=8192")
+			"-fsanitize-coverage="+c.SanitizeCoverage,
+			fmt.Sprintf("-DART_SANITIZE_COVERAGE_MODE=\"%s\"", c.SanitizeCoverage))
+	}
+
+	if c.LargeObjectThreshold > 0 {
+		cflags = append(cflags, fmt.Sprintf("-DART_LARGE_OBJECT_THRESHOLD=%d", c.LargeObjectThreshold))
+	}
+	if c.GcThreadCount > 0 {
+		cflags = append(cflags, fmt.Sprintf("-DART_GC_THREAD_COUNT=%d", c.GcThreadCount))
+	}
+
+	// Changes the inliner of every ART module, so it affects code size and
+	// performance throughout ART. Only meant for inlining experiments.
+	if c.InlineThreshold != nil {
+		cflags = append(cflags, "-mllvm", fmt.Sprintf("-inline-threshold=%d", *c.InlineThreshold))
+	}
+
+	if c.DefaultIsaFeatures != "" {
+		cflags = append(cflags, fmt.Sprintf("-DART_DEFAULT_ISA_FEATURES=\"%s\"", c.DefaultIsaFeatures))
+	}
+
+	for _, arch := range SupportedArches() {
+		cflags = append(cflags, fmt.Sprintf("-DART_STACK_OVERFLOW_GAP_%s=%d", arch, c.StackOverflowGaps[arch]))
+	}
+
+	// ART_FRAME_SIZE_LIMIT is defined per target by deviceFlags and hostFlags, and
+	// code like libartbase/arch/instruction_set.cc checks it against the stack
+	// overflow gaps of its target, so it cannot be made the same on all variants
+	// without loosening those checks. Shared code can static_assert against
+	// ART_MIN_FRAME_SIZE_LIMIT instead, the tightest of the host and device limits.
+	frameSizeLimit := c.DeviceFrameSizeLimit
+	if c.HostFrameSizeLimit < frameSizeLimit {
+		frameSizeLimit = c.HostFrameSizeLimit
 	}
+	cflags = append(cflags, fmt.Sprintf("-DART_MIN_FRAME_SIZE_LIMIT=%d", frameSizeLimit))
 
-	if ctx.Config().IsEnvTrue("ART_ENABLE_ADDRESS_SANITIZER") {
-		// Used to enable full sanitization, i.e., user poisoning, under ASAN.
+	// Host only defines are added by hostFlags.
+	if c.DeviceAddressSanitizer && c.HostAddressSanitizer {
 		cflags = append(cflags, "-DART_ENABLE_ADDRESS_SANITIZER=1")
 		asflags = append(asflags, "-DART_ENABLE_ADDRESS_SANITIZER=1")
 	}
 
-	if !ctx.Config().IsEnvFalse("USE_D8_DESUGAR") {
+	if c.D8DesugarOverridden {
+		cflags = append(cflags, "-DART_D8_DESUGAR_OVERRIDDEN=1")
+	}
+	if c.UseD8Desugar {
 		cflags = append(cflags, "-DUSE_D8_DESUGAR=1")
 	}
 
+	// Undefining NDEBUG is what compiles in the DCHECKs, ART_FORCE_DCHECK only
+	// tells the code that they are forced.
+	if c.ForceAsserts == "all" {
+		cflags = append(cflags, "-UNDEBUG", "-DART_FORCE_DCHECK=1")
+		asflags = append(asflags, "-UNDEBUG")
+	}
+
+	// Identifies the flag-affecting configuration for cache keys and crash triage.
+	cflags = append(cflags, fmt.Sprintf("-DART_BUILD_CONFIG_HASH=\"%s\"", c.ConfigHash))
+
 	return cflags, asflags
 }
 
-func deviceFlags(ctx android.LoadHookContext) []string {
-	var cflags []string
-	deviceFrameSizeLimit := 1736
-	if len(ctx.Config().SanitizeDevice()) > 0 {
-		deviceFrameSizeLimit = 7400
+// Returns whether ART_ENABLE_ADDRESS_SANITIZER is defined on device and on host.
+// An explicit true or false value of the environment variable applies to both.
+// Otherwise full sanitization is enabled by default on the host only, when it
+// is sanitized.
+func addressSanitizerDefines(ctx android.LoadHookContext, hostSanitized bool) (device bool, host bool) {
+	if set, value := envTristate(ctx, "ART_ENABLE_ADDRESS_SANITIZER"); set {
+		return value, value
 	}
-	cflags = append(cflags,
-		fmt.Sprintf("-Wframe-larger-than=%d", deviceFrameSizeLimit),
-		fmt.Sprintf("-DART_FRAME_SIZE_LIMIT=%d", deviceFrameSizeLimit),
-	)
+	return false, hostSanitized
+}
 
-	cflags = append(cflags, "-DART_BASE_ADDRESS="+ctx.Config().LibartImgDeviceBaseAddress())
-	minDelta := ctx.Config().GetenvWithDefault("LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA", "(-0x1000000)")
-	maxDelta := ctx.Config().GetenvWithDefault("LIBART_IMG_TARGET_MAX_BASE_ADDRESS_DELTA", "0x1000000")
-	cflags = append(cflags, "-DART_BASE_ADDRESS_MIN_DELTA="+minDelta)
-	cflags = append(cflags, "-DART_BASE_ADDRESS_MAX_DELTA="+maxDelta)
+// Returns whether a boolean environment variable is set to a true or false value,
+// and which one. Other values are treated as unset.
+func envTristate(ctx android.LoadHookContext, name string) (set bool, value bool) {
+	if ctx.Config().IsEnvTrue(name) {
+		return true, true
+	}
+	if ctx.Config().IsEnvFalse(name) {
+		return true, false
+	}
+	return false, false
+}
+
+// Like envTristate, but falls back to the deprecated oldName when newName is
+// not set. Warns when oldName is used, and reports an error if both are set to
+// different values.
+func resolveAliasedEnv(ctx android.LoadHookContext, newName, oldName string) (set bool, value bool) {
+	newSet, newValue := envTristate(ctx, newName)
+	oldSet, oldValue := envTristate(ctx, oldName)
+	if oldSet {
+		log.Printf("Warning: %s is deprecated, use %s instead", oldName, newName)
+		if newSet && newValue != oldValue {
+			ctx.ModuleErrorf("Conflicting values for %s and %s", newName, oldName)
+		}
+	}
+	if newSet {
+		return newSet, newValue
+	}
+	return oldSet, oldValue
+}
+
+// Returns the value of an environment variable parsed as a positive integer, and
+// whether it is set. Reports an error if it is set to anything else.
+func getenvPositiveInt(ctx android.LoadHookContext, key string) (int, bool) {
+	value := ctx.Config().Getenv(key)
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		ctx.ModuleErrorf("%s must be a positive integer, got %q", key, value)
+		return 0, false
+	}
+	return n, true
+}
+
+var d8DesugarLogOnce sync.Once
+
+// Returns whether USE_D8_DESUGAR is defined for all arches. ART_USE_D8_DESUGAR
+// takes precedence over the global USE_D8_DESUGAR, which must be unset, true or
+// false. Desugaring is on when both are unset.
+func useD8Desugar(ctx android.LoadHookContext) bool {
+	var use bool
+	if ctx.Config().Getenv("ART_USE_D8_DESUGAR") != "" {
+		use = !ctx.Config().IsEnvFalse("ART_USE_D8_DESUGAR")
+	} else {
+		switch value := ctx.Config().Getenv("USE_D8_DESUGAR"); value {
+		case "", "true":
+			use = true
+		case "false":
+			use = false
+		default:
+			ctx.ModuleErrorf("USE_D8_DESUGAR must be unset, true or false, got %q", value)
+			return true
+		}
+	}
+	d8DesugarLogOnce.Do(func() {
+		log.Printf("ART: USE_D8_DESUGAR is %t", use)
+	})
+	return use
+}
 
+// Returns the cflags that are specific to the given arch.
+func archFlags(ctx android.LoadHookContext, c ArtConfig, arch string) []string {
+	var cflags []string
+	cflags = append(cflags, d8DesugarArchFlags(ctx, arch)...)
+	cflags = append(cflags, isaFeatureFlags(c.IsaFeatures[arch])...)
+	cflags = append(cflags, pointerSizeArchFlag(arch))
 	return cflags
 }
 
-func hostFlags(ctx android.LoadHookContext) []string {
+// Returns the define with the pointer size of the given arch. The arch cflags
+// apply to the host and device variants of that arch alike.
+func pointerSizeArchFlag(arch string) string {
+	if strings.HasSuffix(arch, "64") {
+		return "-DART_TARGET_POINTER_SIZE=8"
+	}
+	return "-DART_TARGET_POINTER_SIZE=4"
+}
+
+// Returns the instruction set features of the given arch that are listed,
+// comma separated, in ART_<ARCH>_FEATURES.
+func isaFeatures(ctx android.LoadHookContext, arch string) []string {
+	envVar := "ART_" + strings.ToUpper(arch) + "_FEATURES"
+	var features []string
+	for _, feature := range strings.Split(ctx.Config().Getenv(envVar), ",") {
+		feature = strings.TrimSpace(feature)
+		if feature == "" {
+			continue
+		}
+		if !android.InList(feature, supportedIsaFeatures[arch]) {
+			ctx.ModuleErrorf("Unknown feature %q in %s, expected one of %s",
+				feature, envVar, strings.Join(supportedIsaFeatures[arch], ", "))
+			continue
+		}
+		features = append(features, feature)
+	}
+	return android.FirstUniqueStrings(features)
+}
+
+// Returns the defines for the given instruction set features, e.g.
+// ART_ISA_FEATURE_SVE for sve.
+func isaFeatureFlags(features []string) []string {
 	var cflags []string
-	hostFrameSizeLimit := 1736
-	if len(ctx.Config().SanitizeHost()) > 0 {
+	for _, feature := range features {
+		name := strings.ToUpper(strings.ReplaceAll(feature, ".", "_"))
+		cflags = append(cflags, "-DART_ISA_FEATURE_"+name+"=1")
+	}
+	return cflags
+}
+
+// Returns the define that enables implicit null checks on devices of the given
+// arch, unless ART_IMPLICIT_NULL_CHECKS_<arch> is false, e.g. for boards whose
+// signal handling is not ready yet. Explicit null checks do not depend on
+// ART_DEVICE_KEEP_NULL_CHECKS, which is only needed for implicit ones.
+func implicitNullChecksArchFlag(ctx android.LoadHookContext, arch string) string {
+	envVar := "ART_IMPLICIT_NULL_CHECKS_" + arch
+	set, value := envTristate(ctx, envVar)
+	if !set && ctx.Config().Getenv(envVar) != "" {
+		ctx.ModuleErrorf("%s must be true or false, got %q", envVar, ctx.Config().Getenv(envVar))
+	}
+	if set && !value {
+		return "-DART_IMPLICIT_NULL_CHECKS=0"
+	}
+	return "-DART_IMPLICIT_NULL_CHECKS=1"
+}
+
+// Returns the cflags for the given arch that apply ART_USE_D8_DESUGAR_<arch>,
+// which takes precedence over the setting for all arches.
+func d8DesugarArchFlags(ctx android.LoadHookContext, arch string) []string {
+	envVar := "ART_USE_D8_DESUGAR_" + arch
+	set, value := envTristate(ctx, envVar)
+	if !set {
+		if ctx.Config().Getenv(envVar) != "" {
+			ctx.ModuleErrorf("%s must be true or false, got %q", envVar, ctx.Config().Getenv(envVar))
+		}
+		return nil
+	}
+	if value == useD8Desugar(ctx) {
+		return nil
+	}
+	if value {
+		return []string{"-DUSE_D8_DESUGAR=1"}
+	}
+	return []string{"-UUSE_D8_DESUGAR"}
+}
+
+// Returns where DCHECKs should be compiled in regardless of NDEBUG, as selected
+// by ART_FORCE_ASSERTS: "debug" (also accepted as "true") for the debug variants
+// only, "all" for every variant, or "" when not forced.
+func forceAssertsMode(ctx android.LoadHookContext) string {
+	switch mode := ctx.Config().Getenv("ART_FORCE_ASSERTS"); mode {
+	case "", "false":
+		return ""
+	case "true", "debug":
+		return "debug"
+	case "all":
+		return "all"
+	default:
+		ctx.ModuleErrorf("Unknown ART_FORCE_ASSERTS %q, expected one of debug, all or false", mode)
+		return ""
+	}
+}
+
+// We need larger stack overflow guards for ASAN, as the compiled code will have
+// larger frame sizes. The gaps are global rather than per target: the overflow
+// gap is compiled into managed code, and the host dex2oat compiles the boot
+// image and preopted code for the device. So host and device must agree on the
+// gap, which is the sanitized one if either of them is sanitized.
+// Note: We increase this for both debug and non-debug, as the overflow gap will
+// be compiled into managed code. We always preopt (and build core images) with
+// the debug version. So make the gap consistent (and adjust for the worst).
+func stackOverflowGaps(ctx android.LoadHookContext, sanitized bool) map[string]int {
+	gaps := make(map[string]int)
+	for _, arch := range SupportedArches() {
+		gap := 8192
+		if sanitized {
+			gap = 16384
+			if arch == "x86_64" {
+				gap = 20480
+			}
+		}
+		// Allow overriding the gap, e.g. for deep recursion stress testing. The
+		// runtime protects the gap with whole pages.
+		envVar := "ART_STACK_OVERFLOW_GAP_" + arch
+		if override, ok := getenvPositiveInt(ctx, envVar); ok {
+			if override%stackOverflowGapAlignment != 0 {
+				ctx.ModuleErrorf("%s must be a multiple of %d, got %d", envVar, stackOverflowGapAlignment, override)
+			} else {
+				gap = override
+			}
+		}
+		gaps[arch] = gap
+	}
+	return gaps
+}
+
+// The page size that the stack overflow gaps must be aligned to, see kPageSize
+// in libartbase/base/globals.h.
+const stackOverflowGapAlignment = 4096
+
+// Reports an error if a frame size limit is not less than the stack overflow
+// gap of every arch, as asserted in libartbase/arch/instruction_set.cc. Both
+// can be overridden, so they are checked together.
+func checkFrameSizeLimits(ctx android.LoadHookContext, c ArtConfig) {
+	for _, arch := range SupportedArches() {
+		gap := c.StackOverflowGaps[arch]
+		if c.DeviceFrameSizeLimit >= gap {
+			ctx.ModuleErrorf("The device frame size limit %d must be less than the stack overflow gap %d of %s",
+				c.DeviceFrameSizeLimit, gap, arch)
+		}
+		if c.HostFrameSizeLimit >= gap {
+			ctx.ModuleErrorf("The host frame size limit %d must be less than the stack overflow gap %d of %s",
+				c.HostFrameSizeLimit, gap, arch)
+		}
+	}
+}
+
+// The device frame size limit when any sanitizer is enabled. The limit of each
+// sanitizer in supportedExtraSanitizers can be adjusted with
+// ART_DEVICE_FRAME_SIZE_LIMIT_<sanitizer>, e.g. for the smaller frames of
+// hwaddress.
+const sanitizedDeviceFrameSizeLimit = 7400
+
+// Returns the device frame size limit, which is the largest limit of the given
+// device sanitizers.
+func deviceFrameSizeLimit(ctx android.LoadHookContext, sanitizers []string) int {
+	limit := 1736
+	for _, sanitizer := range sanitizers {
+		sanitizerLimit := sanitizedDeviceFrameSizeLimit
+		if android.InList(sanitizer, supportedExtraSanitizers) {
+			if override, ok := getenvPositiveInt(ctx, "ART_DEVICE_FRAME_SIZE_LIMIT_"+sanitizer); ok {
+				sanitizerLimit = override
+			}
+		}
+		if sanitizerLimit > limit {
+			limit = sanitizerLimit
+		}
+	}
+	return limit
+}
+
+func hostFrameSizeLimit(sanitizers []string) int {
+	if len(sanitizers) > 0 {
 		// art/test/137-cfi/cfi.cc
 		// error: stack frame size of 1944 bytes in function 'Java_Main_unwindInProcess'
 		// b/249586057, need larger stack frame for newer clang compilers
-		hostFrameSizeLimit = 10000
-		// cannot add "-fsanitize-address-use-after-return=never" everywhere,
-		// or some file like compiler_driver.o can have stack frame of 30072 bytes.
-		// cflags = append(cflags, "-fsanitize-address-use-after-return=never")
+		return 10000
+	}
+	return 1736
+}
+
+// Returns the flags that limit the frame size of a target to the given limit,
+// and the matching ART_FRAME_SIZE_LIMIT define.
+func frameSizeFlags(c ArtConfig, limit int) []string {
+	cflags := []string{
+		fmt.Sprintf("-Wframe-larger-than=%d", limit),
+		fmt.Sprintf("-DART_FRAME_SIZE_LIMIT=%d", limit),
+	}
+	if c.FrameSizeError {
+		cflags = append(cflags, "-Werror=frame-larger-than")
+	}
+	return cflags
+}
+
+// Returns the flags for the optimization level of a target. A non-empty
+// override replaces ART_NDEBUG_OPT_FLAG, which is already in the global cflags.
+func optFlags(c ArtConfig, override string) []string {
+	var cflags []string
+	opt := c.OptFlag
+	if override != "" {
+		opt = override
+		cflags = append(cflags, opt)
+	}
+	if opt == "-Os" || opt == "-Oz" {
+		cflags = append(cflags, "-DART_SIZE_OPTIMIZED=1")
+	} else {
+		cflags = append(cflags, "-DART_SIZE_OPTIMIZED=0")
+	}
+	return cflags
+}
+
+func deviceFlags(ctx android.LoadHookContext, c ArtConfig) []string {
+	var cflags []string
+	cflags = append(cflags, optFlags(c, c.DeviceOptFlag)...)
+	cflags = append(cflags, frameSizeFlags(c, c.DeviceFrameSizeLimit)...)
+
+	cflags = append(cflags, "-DART_BASE_ADDRESS="+ctx.Config().LibartImgDeviceBaseAddress())
+	cflags = append(cflags, baseAddressDeltaFlags(ctx,
+		"LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA", "LIBART_IMG_TARGET_MAX_BASE_ADDRESS_DELTA")...)
+
+	cflags = append(cflags, bootImageLocationFlag(ctx, "ART_TARGET_DEFAULT_BOOT_IMAGE_LOCATION",
+		"/apex/com.android.art/javalib/boot.art"))
+	cflags = append(cflags, clangPathFlag(ctx.Config()), clangPathHashFlag(ctx.Config()))
+
+	// The runtime relies on implicit null checks, i.e. dereferencing a null
+	// pointer raises a SIGSEGV that the fault handler turns into a
+	// NullPointerException. Keep clang from deleting dereferences or null checks
+	// that it considers redundant. Recommended, but off by default.
+	if ctx.Config().IsEnvTrue("ART_DEVICE_KEEP_NULL_CHECKS") {
+		cflags = append(cflags, "-fno-delete-null-pointer-checks")
+	}
+
+	return cflags
+}
+
+// Returns the defines for the min and max base address deltas, read from the
+// given environment variables. The values are passed on verbatim, but must be
+// C integer literals, optionally negative and in parentheses, and min must be
+// less than max.
+func baseAddressDeltaFlags(ctx android.LoadHookContext, minVar, maxVar string) []string {
+	minDelta := ctx.Config().GetenvWithDefault(minVar, "(-0x1000000)")
+	maxDelta := ctx.Config().GetenvWithDefault(maxVar, "0x1000000")
+	minValue, minErr := parseBaseAddressDelta(minDelta)
+	if minErr != nil {
+		ctx.ModuleErrorf("Invalid %s %q: %s", minVar, minDelta, minErr)
+	}
+	maxValue, maxErr := parseBaseAddressDelta(maxDelta)
+	if maxErr != nil {
+		ctx.ModuleErrorf("Invalid %s %q: %s", maxVar, maxDelta, maxErr)
+	}
+	if minErr == nil && maxErr == nil && minValue >= maxValue {
+		ctx.ModuleErrorf("%s %s must be less than %s %s", minVar, minDelta, maxVar, maxDelta)
+	}
+
+	return []string{
+		"-DART_BASE_ADDRESS_MIN_DELTA=" + minDelta,
+		"-DART_BASE_ADDRESS_MAX_DELTA=" + maxDelta,
+		baseAddressDeltaSignFlag(minDelta),
+	}
+}
+
+// Parses a base address delta such as "(-0x1000000)" or "0x1000000".
+func parseBaseAddressDelta(delta string) (int64, error) {
+	s := strings.TrimSpace(delta)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	value, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, errors.New("expected an integer literal like 0x1000000 or (-0x1000000)")
+	}
+	return value, nil
+}
+
+// Returns the define that tells whether the min base address delta, such as
+// "(-0x1000000)", is negative, so that the C++ code does not need to parse it.
+func baseAddressDeltaSignFlag(delta string) string {
+	if strings.HasPrefix(strings.TrimLeft(delta, "( "), "-") {
+		return "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=1"
+	}
+	return "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=0"
+}
+
+// Returns the define for the default boot image location, read from the given
+// environment variable.
+func bootImageLocationFlag(ctx android.LoadHookContext, envVar, def string) string {
+	location := strings.TrimSpace(ctx.Config().GetenvWithDefault(envVar, def))
+	if location == "" {
+		ctx.ModuleErrorf("%s must not be empty", envVar)
 	}
-	cflags = append(cflags,
-		fmt.Sprintf("-Wframe-larger-than=%d", hostFrameSizeLimit),
-		fmt.Sprintf("-DART_FRAME_SIZE_LIMIT=%d", hostFrameSizeLimit),
-	)
+	return fmt.Sprintf("-DART_DEFAULT_BOOT_IMAGE_LOCATION=\"%s\"", location)
+}
+
+func hostFlags(ctx android.LoadHookContext, c ArtConfig) []string {
+	var cflags []string
+	cflags = append(cflags, optFlags(c, c.HostOptFlag)...)
+	// cannot add "-fsanitize-address-use-after-return=never" everywhere,
+	// or some file like compiler_driver.o can have stack frame of 30072 bytes.
+	// cflags = append(cflags, "-fsanitize-address-use-after-return=never")
+	cflags = append(cflags, frameSizeFlags(c, c.HostFrameSizeLimit)...)
 
 	cflags = append(cflags, "-DART_BASE_ADDRESS="+ctx.Config().LibartImgHostBaseAddress())
-	minDelta := ctx.Config().GetenvWithDefault("LIBART_IMG_HOST_MIN_BASE_ADDRESS_DELTA", "(-0x1000000)")
-	maxDelta := ctx.Config().GetenvWithDefault("LIBART_IMG_HOST_MAX_BASE_ADDRESS_DELTA", "0x1000000")
-	cflags = append(cflags, "-DART_BASE_ADDRESS_MIN_DELTA="+minDelta)
-	cflags = append(cflags, "-DART_BASE_ADDRESS_MAX_DELTA="+maxDelta)
+	cflags = append(cflags, baseAddressDeltaFlags(ctx,
+		"LIBART_IMG_HOST_MIN_BASE_ADDRESS_DELTA", "LIBART_IMG_HOST_MAX_BASE_ADDRESS_DELTA")...)
+
+	// Relative to ANDROID_HOST_OUT.
+	cflags = append(cflags, bootImageLocationFlag(ctx, "ART_HOST_DEFAULT_BOOT_IMAGE_LOCATION",
+		"apex/art_boot_images/javalib/boot.art"))
 
-	if len(ctx.Config().SanitizeHost()) > 0 && !ctx.Config().IsEnvFalse("ART_ENABLE_ADDRESS_SANITIZER") {
-		// We enable full sanitization on the host by default.
+	if c.HostAddressSanitizer && !c.DeviceAddressSanitizer {
 		cflags = append(cflags, "-DART_ENABLE_ADDRESS_SANITIZER=1")
 	}
 
-	clang_path := filepath.Join(config.ClangDefaultBase, ctx.Config().PrebuiltOS(), config.ClangDefaultVersion)
-	cflags = append(cflags, fmt.Sprintf("-DART_CLANG_PATH=\"%s\"", clang_path))
+	cflags = append(cflags, clangPathFlag(ctx.Config()), clangPathHashFlag(ctx.Config()))
+	cflags = append(cflags, fmt.Sprintf("-DART_HOST_PREBUILT_OS=\"%s\"", hostPrebuiltOS(ctx.Config())))
+
+	// The simulator only runs on host, so its defines must not leak to the device.
+	if c.Simulator {
+		cflags = append(cflags,
+			"-DART_SIMULATOR_ENABLED=1",
+			"-DART_SIMULATOR_TARGET_ISA_IS_"+c.SimulatorIsa+"=1",
+			fmt.Sprintf("-DART_SIMULATOR_TARGET_ISA_NAME=\"%s\"", c.SimulatorIsa))
+	}
+
+	return cflags
+}
+
+// Returns the path of the prebuilt clang toolchain, relative to the top of the
+// tree.
+func artClangPath(c android.Config) string {
+	return filepath.Join(config.ClangDefaultBase, hostPrebuiltOS(c), config.ClangDefaultVersion)
+}
+
+// Returns the define with the path of the prebuilt clang toolchain. It is used
+// to find tools like llvm-addr2line, on host as well as by device side tests.
+func clangPathFlag(config android.Config) string {
+	return fmt.Sprintf("-DART_CLANG_PATH=\"%s\"", artClangPath(config))
+}
+
+// Returns the define with a short, stable hash of the prebuilt clang toolchain
+// path. Crash triage compares it to detect binaries built with a different
+// toolchain.
+func clangPathHashFlag(c android.Config) string {
+	h := fnv.New32a()
+	h.Write([]byte(artClangPath(c)))
+	return fmt.Sprintf("-DART_CLANG_PATH_HASH=\"%08x\"", h.Sum32())
+}
+
+// Returns the prebuilt OS (e.g. linux-x86) that host tools are built against.
+// ART_CLANG_PREBUILT_OS can be used to override the value from the config.
+func hostPrebuiltOS(config android.Config) string {
+	return config.GetenvWithDefault("ART_CLANG_PREBUILT_OS", config.PrebuiltOS())
+}
+
+func globalDefaults(ctx android.LoadHookContext) {
+	type sanitizeProps struct {
+		Address          *bool
+		Hwaddress        *bool
+		Thread           *bool
+		Undefined        *bool
+		Integer_overflow *bool
+	}
+
+	type props struct {
+		Target struct {
+			Android struct {
+				Cflags   []string
+				Sanitize sanitizeProps
+			}
+			Host struct {
+				Cflags   []string
+				Sanitize sanitizeProps
+			}
+			Android_arm, Android_arm64, Android_riscv64, Android_x86, Android_x86_64 struct {
+				Cflags []string
+			}
+		}
+		Arch struct {
+			Arm, Arm64, Riscv64, X86, X86_64 struct {
+				Cflags []string
+			}
+		}
+		Cflags   []string
+		Asflags  []string
+		Ldflags  []string
+		Sanitize struct {
+			Recover []string
+		}
+		Lto struct {
+			Never *bool
+			Thin  *bool
+		}
+	}
+
+	c := artBuildConfig(ctx)
+	ctx.Config().Once(buildConfigKey, func() interface{} { return c })
+
+	p := &props{}
+	p.Cflags, p.Asflags = globalFlags(c)
+	p.Target.Android.Cflags = deviceFlags(ctx, c)
+	p.Arch.Arm.Cflags = archFlags(ctx, c, "arm")
+	p.Arch.Arm64.Cflags = archFlags(ctx, c, "arm64")
+	p.Arch.Riscv64.Cflags = archFlags(ctx, c, "riscv64")
+	p.Arch.X86.Cflags = archFlags(ctx, c, "x86")
+	p.Arch.X86_64.Cflags = archFlags(ctx, c, "x86_64")
+	p.Target.Host.Cflags = hostFlags(ctx, c)
+	p.Target.Android_arm.Cflags = []string{implicitNullChecksArchFlag(ctx, "arm")}
+	p.Target.Android_arm64.Cflags = []string{implicitNullChecksArchFlag(ctx, "arm64")}
+	p.Target.Android_riscv64.Cflags = []string{implicitNullChecksArchFlag(ctx, "riscv64")}
+	p.Target.Android_x86.Cflags = []string{implicitNullChecksArchFlag(ctx, "x86")}
+	p.Target.Android_x86_64.Cflags = []string{implicitNullChecksArchFlag(ctx, "x86_64")}
+
+	// Lets build configs require variables, e.g. a base address that a vendor
+	// must set.
+	for _, name := range strings.Split(ctx.Config().Getenv("ART_REQUIRED_ENV"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && ctx.Config().Getenv(name) == "" {
+			ctx.ModuleErrorf("%s must be set, it is listed in ART_REQUIRED_ENV", name)
+		}
+	}
+
+	// Promote the warnings listed in ART_WERROR_LIST to errors.
+	for _, warning := range strings.Split(ctx.Config().Getenv("ART_WERROR_LIST"), ",") {
+		warning = strings.TrimSpace(warning)
+		if warning == "" {
+			continue
+		}
+		if !warningNameRegexp.MatchString(warning) {
+			ctx.ModuleErrorf("Invalid warning name %q in ART_WERROR_LIST", warning)
+			continue
+		}
+		p.Cflags = append(p.Cflags, "-Werror="+warning)
+	}
+
+	for _, define := range strings.Fields(ctx.Config().Getenv("ART_HOST_EXTRA_DEFINES")) {
+		if !strings.HasPrefix(define, "-D") {
+			ctx.ModuleErrorf("ART_HOST_EXTRA_DEFINES must only contain -D flags, got %q", define)
+			continue
+		}
+		p.Target.Host.Cflags = append(p.Target.Host.Cflags, define)
+	}
+
+	if ctx.Config().IsEnvTrue("ART_DEX_FILE_ACCESS_TRACKING") {
+		p.Cflags = append(p.Cflags, "-DART_DEX_FILE_ACCESS_TRACKING")
+	}
+	p.Sanitize.Recover = globalSanitizeRecover(ctx)
+
+	// Optimize with a profile collected from an ART_PGO_INSTRUMENT build.
+	if c.PgoProfile != "" {
+		p.Cflags = append(p.Cflags, "-fprofile-use="+c.PgoProfile, "-Wno-profile-instr-unprofiled")
+	}
+
+	// Let Soong add the LTO flags, so that it also handles the dependencies and
+	// the modules that opt out with lto: { never: true }. Soong only knows thin
+	// LTO, so full LTO is passed as flags instead, with Soong's own LTO turned
+	// off so that its -flto=thin does not override them.
+	switch c.Lto {
+	case "thin":
+		p.Lto.Thin = proptools.BoolPtr(true)
+	case "full":
+		p.Lto.Never = proptools.BoolPtr(true)
+		p.Cflags = append(p.Cflags, "-flto")
+		p.Ldflags = append(p.Ldflags, "-flto")
+	}
+
+	// One-off flags for experimental builds. They come after the computed flags
+	// so that they can override them, which takes the target cflags for the
+	// per-target flags. Only the flags for a specific device arch, like
+	// -mbranch-protection, still come later.
+	extraCflags := strings.Fields(ctx.Config().Getenv("ART_EXTRA_CFLAGS"))
+	p.Target.Android.Cflags = append(p.Target.Android.Cflags, extraCflags...)
+	p.Target.Host.Cflags = append(p.Target.Host.Cflags, extraCflags...)
+	p.Asflags = append(p.Asflags, strings.Fields(ctx.Config().Getenv("ART_EXTRA_ASFLAGS"))...)
+
+	enableSanitizers := func(s *sanitizeProps, sanitizers []string) {
+		for _, sanitizer := range sanitizers {
+			switch sanitizer {
+			case "address":
+				s.Address = proptools.BoolPtr(true)
+			case "hwaddress":
+				s.Hwaddress = proptools.BoolPtr(true)
+			case "thread":
+				s.Thread = proptools.BoolPtr(true)
+			case "undefined":
+				s.Undefined = proptools.BoolPtr(true)
+			case "integer_overflow":
+				s.Integer_overflow = proptools.BoolPtr(true)
+			}
+		}
+	}
+	enableSanitizers(&p.Target.Android.Sanitize, c.DeviceExtraSanitizers)
+	enableSanitizers(&p.Target.Host.Sanitize, c.HostExtraSanitizers)
+
+	ctx.AppendProperties(p)
+}
+
+// Returns the profile in ART_PGO_PROFILE, or "" when it is not set. The profile
+// must exist.
+func pgoProfile(ctx android.LoadHookContext) string {
+	profile := ctx.Config().Getenv("ART_PGO_PROFILE")
+	if profile == "" {
+		return ""
+	}
+	if !android.ExistentPathForSource(ctx, profile).Valid() {
+		ctx.ModuleErrorf("ART_PGO_PROFILE %q does not exist", profile)
+		return ""
+	}
+	ctx.AddNinjaFileDeps(profile)
+	return profile
+}
+
+var ltoWarningOnce sync.Once
+
+// Returns "thin" when ART_ENABLE_LTO is set, "full" if ART_LTO_FULL is set as
+// well, or "" without LTO.
+func ltoMode(ctx android.LoadHookContext, c ArtConfig) string {
+	if !ctx.Config().IsEnvTrue("ART_ENABLE_LTO") {
+		return ""
+	}
+
+	// Address sanitizer instrumentation does not combine well with LTO.
+	sanitizers := append(android.CopyOf(c.DeviceSanitizers), c.HostSanitizers...)
+	if android.InList("address", sanitizers) || android.InList("hwaddress", sanitizers) {
+		ltoWarningOnce.Do(func() {
+			log.Print("Warning: ART_ENABLE_LTO is not supported with address sanitizers")
+		})
+	}
+
+	if ctx.Config().IsEnvTrue("ART_LTO_FULL") {
+		return "full"
+	}
+	return "thin"
+}
+
+var supportedExtraSanitizers = []string{"address", "hwaddress", "integer_overflow", "thread", "undefined"}
+
+// Sanitizers that cannot be enabled together.
+var incompatibleSanitizers = [][2]string{
+	{"address", "hwaddress"},
+	{"address", "thread"},
+	{"hwaddress", "thread"},
+}
+
+// Reports an error if the sanitizers of the given target, which include the ones
+// from SANITIZE_TARGET or SANITIZE_HOST, cannot be enabled together.
+func checkSanitizerCombination(ctx android.LoadHookContext, target string, sanitizers []string) {
+	for _, pair := range incompatibleSanitizers {
+		if android.InList(pair[0], sanitizers) && android.InList(pair[1], sanitizers) {
+			ctx.ModuleErrorf("ART_EXTRA_SANITIZERS: sanitizers %s and %s cannot be enabled together on %s",
+				pair[0], pair[1], target)
+		}
+	}
+}
+
+// Returns the sanitizers listed in ART_EXTRA_SANITIZERS for the device and the
+// host variants of ART modules. ART_EXTRA_SANITIZERS_VARIANT selects the
+// variants: "device", "host" or "both", which is the default.
+func extraSanitizers(ctx android.LoadHookContext) (device []string, host []string) {
+	var sanitizers []string
+	for _, sanitizer := range strings.Split(ctx.Config().Getenv("ART_EXTRA_SANITIZERS"), ",") {
+		sanitizer = strings.TrimSpace(sanitizer)
+		if sanitizer == "" {
+			continue
+		}
+		if !android.InList(sanitizer, supportedExtraSanitizers) {
+			ctx.ModuleErrorf("Unknown sanitizer %q in ART_EXTRA_SANITIZERS, expected one of %s",
+				sanitizer, strings.Join(supportedExtraSanitizers, ", "))
+			continue
+		}
+		sanitizers = append(sanitizers, sanitizer)
+	}
+	sanitizers = android.FirstUniqueStrings(sanitizers)
+
+	switch variant := ctx.Config().GetenvWithDefault("ART_EXTRA_SANITIZERS_VARIANT", "both"); variant {
+	case "both":
+		return sanitizers, android.CopyOf(sanitizers)
+	case "device":
+		return sanitizers, nil
+	case "host":
+		return nil, sanitizers
+	default:
+		ctx.ModuleErrorf("Unknown ART_EXTRA_SANITIZERS_VARIANT %q, expected one of both, device or host", variant)
+		return nil, nil
+	}
+}
+
+// Hook that enables arm64 branch protection (PAC/BTI) on device when
+// ART_DEVICE_BRANCH_PROTECTION is set. Signing and authenticating return
+// addresses adds a couple of instructions to every non-leaf function, which
+// costs a few percent in interpreter and GC heavy benchmarks.
+func branchProtection(ctx android.LoadHookContext) {
+	value := ctx.Config().GetenvWithDefault("ART_DEVICE_BRANCH_PROTECTION", "off")
+	switch value {
+	case "off":
+		return
+	case "standard", "pac-ret", "bti":
+	default:
+		ctx.ModuleErrorf("Unknown ART_DEVICE_BRANCH_PROTECTION %q, expected one of standard, pac-ret, bti or off", value)
+		return
+	}
+
+	if !hasDeviceArch(ctx, "arm64") {
+		ctx.ModuleErrorf("ART_DEVICE_BRANCH_PROTECTION is only supported on arm64 devices")
+		return
+	}
+
+	type props struct {
+		Target struct {
+			Android_arm64 struct {
+				Cflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Android_arm64.Cflags = []string{"-mbranch-protection=" + value}
+	ctx.AppendProperties(p)
+}
+
+// Target OSes that can be selected with ART_TARGET_OS.
+var supportedTargetOses = []string{"android", "fuchsia", "linux"}
+
+var targetLinuxWarningOnce sync.Once
+
+// Returns the defines that are implicit for the device variants of all cc_art_*
+// modules: ART_TARGET and ART_TARGET_<OS> for the OS selected by ART_TARGET_OS.
+// ART_TARGET_LINUX=true is a deprecated alias of ART_TARGET_OS=linux.
+func implicitTargetDefines(ctx android.LoadHookContext) []string {
+	targetOs := ctx.Config().Getenv("ART_TARGET_OS")
+	if ctx.Config().IsEnvTrue("ART_TARGET_LINUX") {
+		targetLinuxWarningOnce.Do(func() {
+			log.Print("Warning: ART_TARGET_LINUX is deprecated, use ART_TARGET_OS=linux instead")
+		})
+		if targetOs != "" && targetOs != "linux" {
+			ctx.ModuleErrorf("Conflicting values for ART_TARGET_OS and ART_TARGET_LINUX")
+		}
+		targetOs = "linux"
+	}
+	if targetOs == "" {
+		targetOs = "android"
+	}
+	if !android.InList(targetOs, supportedTargetOses) {
+		ctx.ModuleErrorf("Unknown ART_TARGET_OS %q, expected one of %s",
+			targetOs, strings.Join(supportedTargetOses, ", "))
+		targetOs = "android"
+	}
+	return []string{"ART_TARGET", "ART_TARGET_" + strings.ToUpper(targetOs)}
+}
+
+// Hook that enables x86_64 control-flow enforcement (CET) on device when
+// ART_DEVICE_CF_PROTECTION is set.
+func cfProtection(ctx android.LoadHookContext) {
+	value := ctx.Config().GetenvWithDefault("ART_DEVICE_CF_PROTECTION", "off")
+	switch value {
+	case "off":
+		return
+	case "full", "branch", "return":
+	default:
+		ctx.ModuleErrorf("Unknown ART_DEVICE_CF_PROTECTION %q, expected one of full, branch, return or off", value)
+		return
+	}
+
+	if !hasDeviceArch(ctx, "x86_64") {
+		ctx.ModuleErrorf("ART_DEVICE_CF_PROTECTION is only supported on x86_64 devices")
+		return
+	}
+
+	type props struct {
+		Target struct {
+			Android_x86_64 struct {
+				Cflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Android_x86_64.Cflags = []string{"-fcf-protection=" + value}
+	ctx.AppendProperties(p)
+}
+
+// Returns whether the device is configured with the given arch.
+func hasDeviceArch(ctx android.LoadHookContext, arch string) bool {
+	for _, a := range ctx.DeviceConfig().Arches() {
+		if a.ArchType.String() == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// Hook that adds flags that are implicit for all cc_art_* modules.
+func addImplicitFlags(ctx android.LoadHookContext) {
+	type props struct {
+		Target struct {
+			Android struct {
+				Cflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	for _, define := range implicitTargetDefines(ctx) {
+		p.Target.Android.Cflags = append(p.Target.Android.Cflags, "-D"+define)
+	}
+
+	ctx.AppendProperties(p)
+}
+
+// Hook that undefines the implicit flags for modules that opted out of them.
+// The flags are undefined rather than left out, since they are also inherited
+// from art_defaults.
+func removeImplicitFlags(ctx android.LoadHookContext) {
+	type props struct {
+		Target struct {
+			Android struct {
+				Cflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	for _, define := range implicitTargetDefines(ctx) {
+		p.Target.Android.Cflags = append(p.Target.Android.Cflags, "-U"+define)
+	}
+
+	ctx.AppendProperties(p)
+}
+
+type implicitFlagsProperties struct {
+	// Do not define ART_TARGET and ART_TARGET_<OS> for this module. Used by
+	// modules that are shared with non-ART code.
+	No_implicit_art_target_flags *bool
+
+	// Do not define ART_USE_CXX_INTERPRETER for this module, even when it is
+	// enabled globally. Used by the modules of the assembly interpreters, which
+	// cannot be built with it.
+	No_cxx_interpreter *bool
+}
+
+// Hook that undefines ART_USE_CXX_INTERPRETER, which is in the global cflags
+// when enabled, and sets ART_CXX_INTERPRETER_ENABLED to match.
+func removeCxxInterpreterFlag(ctx android.LoadHookContext) {
+	if !ctx.Config().IsEnvTrue("ART_USE_CXX_INTERPRETER") {
+		return
+	}
+
+	type props struct {
+		Cflags []string
+	}
+
+	p := &props{}
+	p.Cflags = []string{
+		"-UART_USE_CXX_INTERPRETER",
+		"-UART_CXX_INTERPRETER_ENABLED",
+		"-DART_CXX_INTERPRETER_ENABLED=0",
+	}
+	ctx.AppendProperties(p)
+}
+
+func installImplicitFlagsCustomizer(module android.Module) {
+	p := &implicitFlagsProperties{}
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		if proptools.Bool(p.No_implicit_art_target_flags) {
+			removeImplicitFlags(ctx)
+		} else {
+			addImplicitFlags(ctx)
+		}
+		if proptools.Bool(p.No_cxx_interpreter) {
+			removeCxxInterpreterFlag(ctx)
+		}
+	})
+	module.AddProperties(p)
+}
+
+// Returns the sanitizers whose checks are recoverable in all ART modules.
+func globalSanitizeRecover(ctx android.LoadHookContext) []string {
+	if ctx.Config().IsEnvTrue("ART_DEX_FILE_ACCESS_TRACKING") {
+		return []string{"address"}
+	}
+	return nil
+}
+
+type sanitizeRecoverProperties struct {
+	// Sanitizers whose checks should be recoverable in this module, e.g.
+	// "integer". Merged with the recover list of the ART global defaults.
+	Sanitize_recover []string
+}
+
+// Hook that adds the sanitizers in sanitize_recover to sanitize.recover,
+// leaving out the ones that the global defaults already recover.
+func sanitizeRecover(ctx android.LoadHookContext, r *sanitizeRecoverProperties) {
+	var recover []string
+	for _, sanitizer := range android.FirstUniqueStrings(r.Sanitize_recover) {
+		if android.InList(sanitizer, globalSanitizeRecover(ctx)) {
+			continue
+		}
+		recover = append(recover, sanitizer)
+	}
+	if len(recover) == 0 {
+		return
+	}
+
+	type props struct {
+		Sanitize struct {
+			Recover []string
+		}
+	}
+
+	p := &props{}
+	p.Sanitize.Recover = recover
+	ctx.AppendProperties(p)
+}
+
+func installSanitizeRecoverCustomizer(module android.Module) {
+	r := &sanitizeRecoverProperties{}
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { sanitizeRecover(ctx, r) })
+	module.AddProperties(r)
+}
+
+// Linker paths that CUSTOM_TARGET_LINKER is expected to match.
+var knownLinkerRegexp = regexp.MustCompile(`^(/system|/apex/[^/]+)/bin/linker(64)?$`)
+
+var customLinkerWarningOnce sync.Once
+
+func customLinker(ctx android.LoadHookContext) {
+	linker := ctx.Config().Getenv("CUSTOM_TARGET_LINKER")
+	type props struct {
+		DynamicLinker string
+	}
+
+	p := &props{}
+	if linker != "" {
+		// The loader path is embedded in the binaries, and a malformed one only
+		// shows up when they fail to launch on the device.
+		if strings.TrimSpace(linker) == "" {
+			ctx.ModuleErrorf("CUSTOM_TARGET_LINKER must not be blank")
+			return
+		}
+		if !filepath.IsAbs(linker) {
+			ctx.ModuleErrorf("CUSTOM_TARGET_LINKER %q must be an absolute path", linker)
+			return
+		}
+		if !knownLinkerRegexp.MatchString(linker) {
+			// Usually a mistake, but still honored unless ART_STRICT_CUSTOM_LINKER is set.
+			if ctx.Config().IsEnvTrue("ART_STRICT_CUSTOM_LINKER") {
+				ctx.ModuleErrorf("CUSTOM_TARGET_LINKER %q is not a known linker path", linker)
+			} else {
+				customLinkerWarningOnce.Do(func() {
+					log.Printf("Warning: CUSTOM_TARGET_LINKER %q is not a known linker path", linker)
+				})
+			}
+		}
+		p.DynamicLinker = linker
+	}
+
+	ctx.AppendProperties(p)
+}
+
+// Returns whether the module is listed, comma separated, in the given
+// environment variable.
+func moduleInEnvList(ctx android.LoadHookContext, envVar string) bool {
+	for _, module := range strings.Split(ctx.Config().Getenv(envVar), ",") {
+		if strings.TrimSpace(module) == ctx.ModuleName() {
+			return true
+		}
+	}
+	return false
+}
+
+// Hook that makes clang emit a .su file with the stack usage of every function
+// next to the object files of the modules listed, comma separated, in
+// ART_EMIT_STACK_USAGE.
+func stackUsage(ctx android.LoadHookContext) {
+	if !moduleInEnvList(ctx, "ART_EMIT_STACK_USAGE") {
+		return
+	}
+
+	type props struct {
+		Cflags []string
+	}
+
+	p := &props{}
+	p.Cflags = []string{"-fstack-usage"}
+	ctx.AppendProperties(p)
+}
+
+// Hook that instruments device code for PGO when ART_PGO_INSTRUMENT is set to
+// the directory where the raw profiles should be written.
+func pgoInstrument(ctx android.LoadHookContext) {
+	dir := ctx.Config().Getenv("ART_PGO_INSTRUMENT")
+	if dir == "" {
+		return
+	}
+	if ctx.Config().Getenv("ART_PGO_PROFILE_DIR") != "" {
+		ctx.ModuleErrorf("ART_PGO_INSTRUMENT and ART_PGO_PROFILE_DIR cannot be set together")
+		return
+	}
+	if ctx.Config().Getenv("ART_PGO_PROFILE") != "" {
+		ctx.ModuleErrorf("ART_PGO_INSTRUMENT and ART_PGO_PROFILE cannot be set together")
+		return
+	}
+
+	type props struct {
+		Target struct {
+			Android struct {
+				Cflags  []string
+				Ldflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Android.Cflags = []string{"-fprofile-generate=" + dir}
+	p.Target.Android.Ldflags = []string{"-fprofile-generate=" + dir}
+	ctx.AppendProperties(p)
+}
+
+// Hook that compiles the modules listed, comma separated, in ART_O0_MODULES
+// with -O0 for a faster edit-build cycle.
+func o0Modules(ctx android.LoadHookContext) {
+	if !moduleInEnvList(ctx, "ART_O0_MODULES") {
+		return
+	}
+
+	type props struct {
+		Target struct {
+			Android struct {
+				Cflags []string
+			}
+			Host struct {
+				Cflags []string
+			}
+		}
+	}
+
+	// Use the target cflags, so that -O0 comes after the per-target overrides
+	// of ART_NDEBUG_OPT_FLAG in the defaults.
+	p := &props{}
+	p.Target.Android.Cflags = []string{"-O0"}
+	p.Target.Host.Cflags = []string{"-O0"}
+	ctx.AppendProperties(p)
+}
+
+// Hook that passes the linker script fragment in ART_DEVICE_LINKER_SCRIPT, a
+// path relative to the top of the tree, to the device variants of ART binaries
+// and shared libraries. Some boards need it to place extra sections.
+func deviceLinkerScript(ctx android.LoadHookContext) {
+	script := ctx.Config().Getenv("ART_DEVICE_LINKER_SCRIPT")
+	if script == "" {
+		return
+	}
+	if !android.ExistentPathForSource(ctx, script).Valid() {
+		ctx.ModuleErrorf("ART_DEVICE_LINKER_SCRIPT %q does not exist", script)
+		return
+	}
+	// Rerun Soong when the script is added or removed.
+	ctx.AddNinjaFileDeps(script)
+
+	type props struct {
+		Target struct {
+			Android struct {
+				Ldflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Android.Ldflags = []string{"-Wl,-T" + script}
+	ctx.AppendProperties(p)
+}
+
+// Linker script fragment that discards the .comment section.
+const stripCommentScript = "art/build/strip_comment.ld"
+
+// Hook that drops the .comment section from the device variants of ART
+// binaries and shared libraries when ART_STRIP_COMMENT is set, to avoid
+// leaking the toolchain version. -fno-ident is not enough, as lld adds its own
+// entry and has no option to omit it.
+func stripComment(ctx android.LoadHookContext) {
+	if !ctx.Config().IsEnvTrue("ART_STRIP_COMMENT") {
+		return
+	}
+
+	type props struct {
+		Target struct {
+			Android struct {
+				Ldflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Android.Ldflags = []string{"-Wl,-T" + stripCommentScript}
+	ctx.AppendProperties(p)
+}
 
-	return cflags
+type hostOnlyProperties struct {
+	// The host_supported property of the module itself, read before the
+	// properties from defaults are applied.
+	Host_supported *bool
 }
 
-func globalDefaults(ctx android.LoadHookContext) {
+// Hook that disables the device variants of all ART modules when ART_HOST_ONLY
+// is set, for host-only SDK builds.
+func hostOnly(ctx android.LoadHookContext, h *hostOnlyProperties) {
+	if !ctx.Config().IsEnvTrue("ART_HOST_ONLY") {
+		return
+	}
+
+	// Only warn about modules that opt out of the host explicitly. Whether the
+	// others are built for the host depends on their defaults, which are not
+	// applied yet at this point.
+	if h.Host_supported != nil && !*h.Host_supported {
+		log.Print("Warning: " + ctx.ModuleName() + " does not support host and is not built for ART_HOST_ONLY=true")
+	}
+
 	type props struct {
 		Target struct {
 			Android struct {
-				Cflags []string
+				Enabled *bool
 			}
+		}
+	}
+
+	p := &props{}
+	p.Target.Android.Enabled = proptools.BoolPtr(false)
+	ctx.AppendProperties(p)
+}
+
+func installHostOnlyCustomizer(module android.Module) {
+	h := &hostOnlyProperties{}
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { hostOnly(ctx, h) })
+	module.AddProperties(h)
+}
+
+type multilibProperties struct {
+	// Compile_multilib to use for this module, one of "32", "64", "both", "first"
+	// or "prefer32". Takes precedence over HOST_PREFER_32_BIT and
+	// ART_TARGET_PREFER_32_BIT, but can still be overridden with compile_multilib.
+	Art_compile_multilib *string
+}
+
+var supportedCompileMultilibs = []string{"32", "64", "both", "first", "prefer32"}
+
+func prefer32Bit(ctx android.LoadHookContext, m *multilibProperties) {
+	type props struct {
+		Compile_multilib *string
+		Target           struct {
 			Host struct {
-				Cflags []string
+				Compile_multilib *string
+			}
+			Android struct {
+				Compile_multilib *string
 			}
-		}
-		Cflags   []string
-		Asflags  []string
-		Sanitize struct {
-			Recover []string
 		}
 	}
 
 	p := &props{}
-	p.Cflags, p.Asflags = globalFlags(ctx)
-	p.Target.Android.Cflags = deviceFlags(ctx)
-	p.Target.Host.Cflags = hostFlags(ctx)
-
-	if ctx.Config().IsEnvTrue("ART_DEX_FILE_ACCESS_TRACKING") {
-		p.Cflags = append(p.Cflags, "-DART_DEX_FILE_ACCESS_TRACKING")
-		p.Sanitize.Recover = []string{
-			"address",
+	if multilib := proptools.String(m.Art_compile_multilib); multilib != "" {
+		if !android.InList(multilib, supportedCompileMultilibs) {
+			ctx.PropertyErrorf("art_compile_multilib", "unknown value %q, expected one of %s",
+				multilib, strings.Join(supportedCompileMultilibs, ", "))
+			return
+		}
+		p.Compile_multilib = proptools.StringPtr(multilib)
+	} else {
+		if ctx.Config().IsEnvTrue("HOST_PREFER_32_BIT") {
+			p.Target.Host.Compile_multilib = proptools.StringPtr("prefer32")
+		}
+		// Used to save memory when bringing up low-memory devices.
+		if ctx.Config().IsEnvTrue("ART_TARGET_PREFER_32_BIT") {
+			p.Target.Android.Compile_multilib = proptools.StringPtr("prefer32")
 		}
 	}
 
-	ctx.AppendProperties(p)
+	// Prepend to make it overridable in the blueprints. Note that it doesn't work
+	// to override the property in a cc_defaults module.
+	ctx.PrependProperties(p)
 }
 
-// Hook that adds flags that are implicit for all cc_art_* modules.
-func addImplicitFlags(ctx android.LoadHookContext) {
+func installMultilibCustomizer(module android.Module) {
+	m := &multilibProperties{}
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { prefer32Bit(ctx, m) })
+	module.AddProperties(m)
+}
+
+type artTestProperties struct {
+	// Enable C++ exceptions in the host variant of this test, e.g. for death tests
+	// that use third-party frameworks. Exceptions are disabled by default.
+	Allow_exceptions *bool
+
+	// Data files to copy next to the host variant of this test in the testcases
+	// directory, as <src>:<dst> pairs like PRODUCT_COPY_FILES. src is relative to
+	// the module directory, and dst to the directory of the test binary.
+	Testcases_data_map []string
+
+	// Names of the test suites this test belongs to, e.g. "gcstress" or "jit",
+	// so that test runners can select them with ArtTestSuites.
+	Art_test_suites []string
+
+	// Device features this test needs, e.g. "64bit" or an ISA feature, so that
+	// test harnesses can skip it on other hardware with ArtTestRequirements.
+	Art_test_requires []string
+}
+
+// Hook that adds the flags requested by the properties of an art_cc_test.
+func testFlags(ctx android.LoadHookContext, t *artTestProperties) {
 	type props struct {
 		Target struct {
-			Android struct {
+			Host struct {
 				Cflags []string
 			}
 		}
 	}
 
 	p := &props{}
-	if ctx.Config().IsEnvTrue("ART_TARGET_LINUX") {
-		p.Target.Android.Cflags = []string{"-DART_TARGET", "-DART_TARGET_LINUX"}
-	} else {
-		p.Target.Android.Cflags = []string{"-DART_TARGET", "-DART_TARGET_ANDROID"}
+	if proptools.Bool(t.Allow_exceptions) {
+		p.Target.Host.Cflags = append(p.Target.Host.Cflags, "-fexceptions")
 	}
 
 	ctx.AppendProperties(p)
 }
 
-func customLinker(ctx android.LoadHookContext) {
-	linker := ctx.Config().Getenv("CUSTOM_TARGET_LINKER")
-	type props struct {
-		DynamicLinker string
+// Hook that records the suites listed in art_test_suites.
+func addTestSuites(ctx android.LoadHookContext, t *artTestProperties) {
+	if len(t.Art_test_suites) == 0 {
+		return
 	}
 
-	p := &props{}
-	if linker != "" {
-		p.DynamicLinker = linker
+	testSuites := testSuitesMap(ctx.Config())
+
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	for _, suite := range android.FirstUniqueStrings(t.Art_test_suites) {
+		if suite == "" {
+			ctx.PropertyErrorf("art_test_suites", "suite names must not be empty")
+			continue
+		}
+		testSuites[suite] = append(testSuites[suite], ctx.ModuleName())
+	}
+}
+
+// Hook that records the requirements listed in art_test_requires.
+func addTestRequirements(ctx android.InstallHookContext, t *artTestProperties) {
+	if len(t.Art_test_requires) == 0 {
+		return
 	}
 
-	ctx.AppendProperties(p)
+	testRequirements := testRequirementsMap(ctx.Config())
+
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	name := testMapName(ctx)
+	testRequirements[name] = android.FirstUniqueStrings(append(testRequirements[name], t.Art_test_requires...))
 }
 
-func prefer32Bit(ctx android.LoadHookContext) {
+func installTestCustomizer(module android.Module) {
+	t := &artTestProperties{}
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		testFlags(ctx, t)
+		addTestSuites(ctx, t)
+	})
+	android.AddInstallHook(module, func(ctx android.InstallHookContext) {
+		addTestcasesData(ctx, t)
+		addTestRequirements(ctx, t)
+	})
+	module.AddProperties(t)
+}
+
+type artTestLibraryProperties struct {
+	// Which variants of this test library to build: "both" (the default),
+	// "shared" or "static".
+	Test_library_linkage *string
+}
+
+// Hook that disables the variants of an art_cc_test_library that are not
+// selected by test_library_linkage, and returns the matching codegen module
+// type.
+func testLibraryLinkage(ctx android.LoadHookContext, l *artTestLibraryProperties) moduleType {
 	type props struct {
-		Target struct {
-			Host struct {
-				Compile_multilib *string
-			}
+		Static struct {
+			Enabled *bool
+		}
+		Shared struct {
+			Enabled *bool
 		}
 	}
 
 	p := &props{}
-	if ctx.Config().IsEnvTrue("HOST_PREFER_32_BIT") {
-		p.Target.Host.Compile_multilib = proptools.StringPtr("prefer32")
+	var t moduleType
+	switch linkage := proptools.StringDefault(l.Test_library_linkage, "both"); linkage {
+	case "both":
+		return staticAndSharedLibrary
+	case "shared":
+		p.Static.Enabled = proptools.BoolPtr(false)
+		t = sharedLibrary
+	case "static":
+		p.Shared.Enabled = proptools.BoolPtr(false)
+		t = staticLibrary
+	default:
+		ctx.PropertyErrorf("test_library_linkage", "unknown value %q, expected one of both, shared or static", linkage)
+		return staticAndSharedLibrary
 	}
 
-	// Prepend to make it overridable in the blueprints. Note that it doesn't work
-	// to override the property in a cc_defaults module.
-	ctx.PrependProperties(p)
+	ctx.AppendProperties(p)
+	return t
 }
 
+// Like installCodegenCustomizer, but picks the codegen module type from the
+// test_library_linkage property.
+func installTestLibraryCustomizer(module android.Module) {
+	c := &codegenProperties{}
+	l := &artTestLibraryProperties{}
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		codegen(ctx, c, testLibraryLinkage(ctx, l))
+	})
+	module.AddProperties(c, l)
+}
+
+// The ArtConfig resolved by the global defaults, dumped by the art_build_config
+// singleton.
+var buildConfigKey = android.NewOnceKey("artBuildConfig")
+
 var testMapKey = android.NewOnceKey("artTests")
 
 func testMap(config android.Config) map[string][]string {
@@ -268,20 +1860,132 @@ func testMap(config android.Config) map[string][]string {
 	}).(map[string][]string)
 }
 
-func testInstall(ctx android.InstallHookContext) {
-	testMap := testMap(ctx.Config())
+var testSuitesKey = android.NewOnceKey("artTestSuites")
+
+// Names of the ART test modules, keyed by the suites in their art_test_suites.
+func testSuitesMap(config android.Config) map[string][]string {
+	return config.Once(testSuitesKey, func() interface{} {
+		return make(map[string][]string)
+	}).(map[string][]string)
+}
+
+var testRequirementsKey = android.NewOnceKey("artTestRequirements")
+
+// Requirements of the tests in testMap from art_test_requires, with the same keys.
+func testRequirementsMap(config android.Config) map[string][]string {
+	return config.Once(testRequirementsKey, func() interface{} {
+		return make(map[string][]string)
+	}).(map[string][]string)
+}
+
+var testMapDirsKey = android.NewOnceKey("artTestDirs")
+
+// Directories of the modules that installed the tests in testMap, used to detect
+// tests with the same name in different namespaces.
+func testMapDirs(config android.Config) map[string]string {
+	return config.Once(testMapDirsKey, func() interface{} {
+		return make(map[string]string)
+	}).(map[string]string)
+}
+
+// ArtTestMap returns a copy of the installed paths of the ART tests, keyed by
+// "host_" or "device_" followed by the arch and the module name, e.g.
+// "device_arm64_art_runtime_tests". It is populated when the tests are
+// installed, so it should only be read from singletons.
+func ArtTestMap(config android.Config) map[string][]string {
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	ret := make(map[string][]string)
+	for name, paths := range testMap(config) {
+		ret[name] = android.CopyOf(paths)
+	}
+	return ret
+}
+
+// ArtTestRequirements returns a copy of the device requirements that the ART
+// tests declare in art_test_requires, with the same keys as ArtTestMap. Tests
+// without requirements are not included.
+func ArtTestRequirements(config android.Config) map[string][]string {
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	ret := make(map[string][]string)
+	for name, requirements := range testRequirementsMap(config) {
+		ret[name] = android.CopyOf(requirements)
+	}
+	return ret
+}
+
+// ArtTestSuites returns a copy of the names of the ART test modules, keyed by
+// the suites they declare in art_test_suites, e.g. "gcstress". The names are
+// sorted.
+func ArtTestSuites(config android.Config) map[string][]string {
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	ret := make(map[string][]string)
+	for suite, modules := range testSuitesMap(config) {
+		ret[suite] = android.SortedUniqueStrings(modules)
+	}
+	return ret
+}
+
+// ArtTestPaths returns the installed paths of the ART tests for the given arch,
+// keyed by module name.
+func ArtTestPaths(config android.Config, host bool, arch string) map[string][]string {
+	variant := "device_"
+	if host {
+		variant = "host_"
+	}
+
+	ret := make(map[string][]string)
+	for name, paths := range ArtTestMap(config) {
+		if !strings.HasPrefix(name, variant+arch+"_") {
+			continue
+		}
+		// Skip the tests of arches that start with the requested one, e.g.
+		// x86_64 tests when looking for x86.
+		otherArch := false
+		for _, a := range SupportedArches() {
+			if a != arch && strings.HasPrefix(a, arch) && strings.HasPrefix(name, variant+a+"_") {
+				otherArch = true
+			}
+		}
+		if !otherArch {
+			ret[strings.TrimPrefix(name, variant+arch+"_")] = paths
+		}
+	}
+	return ret
+}
 
+// Returns the key of the test in testMap, e.g. "device_arm64_art_runtime_tests".
+func testMapName(ctx android.InstallHookContext) string {
 	var name string
 	if ctx.Host() {
 		name = "host_"
 	} else {
 		name = "device_"
 	}
-	name += ctx.Arch().ArchType.String() + "_" + ctx.ModuleName()
+	return name + ctx.Arch().ArchType.String() + "_" + ctx.ModuleName()
+}
+
+func testInstall(ctx android.InstallHookContext) {
+	testMap := testMap(ctx.Config())
+	name := testMapName(ctx)
 
 	artTestMutex.Lock()
 	defer artTestMutex.Unlock()
 
+	// A test can install several files, but they must all come from the same module.
+	testMapDirs := testMapDirs(ctx.Config())
+	if dir, ok := testMapDirs[name]; ok && dir != ctx.ModuleDir() {
+		ctx.ModuleErrorf("Conflicting tests for %s in %s and %s: %s",
+			name, dir, ctx.ModuleDir(), strings.Join(append(android.CopyOf(testMap[name]), ctx.Path().String()), " "))
+		return
+	}
+	testMapDirs[name] = ctx.ModuleDir()
+
 	tests := testMap[name]
 	tests = append(tests, ctx.Path().String())
 	testMap[name] = tests
@@ -289,18 +1993,53 @@ func testInstall(ctx android.InstallHookContext) {
 
 var testcasesContentKey = android.NewOnceKey("artTestcasesContent")
 
-func testcasesContent(config android.Config) map[string]string {
+// A file to copy in the testcases directory.
+type testcasesFile struct {
+	// Path to copy the file from.
+	Src string
+	// Name of the module that produced the file.
+	Module string
+}
+
+func testcasesContent(config android.Config) map[string]testcasesFile {
 	return config.Once(testcasesContentKey, func() interface{} {
-		return make(map[string]string)
-	}).(map[string]string)
+		return make(map[string]testcasesFile)
+	}).(map[string]testcasesFile)
+}
+
+// ArtTestcasesContent returns a copy of the files that are copied in the host
+// testcases directory, as paths relative to it mapped to the paths to copy them
+// from. It is populated when the modules are installed, so it should only be
+// read from singletons, e.g. to package the testcases without Make.
+func ArtTestcasesContent(config android.Config) map[string]string {
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	ret := make(map[string]string)
+	for dst, file := range testcasesContent(config) {
+		ret[dst] = file.Src
+	}
+	return ret
+}
+
+type testcasesProperties struct {
+	// Copy the module into the testcases directory even for host cross targets,
+	// which are skipped by default. The files are staged under host-cross/.
+	Force_testcases_staging *bool
 }
 
 // Binaries and libraries also need to be copied in the testcases directory for
 // running tests on host.  This method adds module to the list of needed files.
-// The 'key' is the file in testcases and 'value' is the path to copy it from.
+// The 'key' is the file in testcases and 'value' is the path to copy it from,
+// along with the module it belongs to.
 // The actual copy will be done in make since soong does not do installations.
-func addTestcasesFile(ctx android.InstallHookContext) {
-	if ctx.Os() != ctx.Config().BuildOS || ctx.Target().HostCross || ctx.Module().IsSkipInstall() {
+func addTestcasesFile(ctx android.InstallHookContext, p *testcasesProperties) {
+	hostCross := ctx.Target().HostCross
+	forced := hostCross && proptools.Bool(p.Force_testcases_staging)
+	if !forced && (ctx.Os() != ctx.Config().BuildOS || hostCross) {
+		return
+	}
+	if ctx.Module().IsSkipInstall() {
 		return
 	}
 
@@ -309,14 +2048,108 @@ func addTestcasesFile(ctx android.InstallHookContext) {
 	artTestMutex.Lock()
 	defer artTestMutex.Unlock()
 
-	src := ctx.SrcPath().String()
+	addTestcasesEntry(ctx, testcasesContent, testcasesPath(ctx), ctx.SrcPath().String())
+}
+
+// Returns the path of the installed file of the module in the testcases
+// directory.
+func testcasesPath(ctx android.InstallHookContext) string {
 	path := strings.Split(ctx.Path().String(), "/")
-	// Keep last two parts of the install path (e.g. bin/dex2oat).
-	dst := strings.Join(path[len(path)-2:], "/")
-	if oldSrc, ok := testcasesContent[dst]; ok {
-		ctx.ModuleErrorf("Conflicting sources for %s: %s and %s", dst, oldSrc, src)
+	// Keep last two parts of the install path (e.g. bin/dex2oat), or three for
+	// files installed in an arch subdirectory (e.g. bin/arm64/dex2oat) so that
+	// they do not collide with other arches.
+	keep := 2
+	if len(path) >= 3 && android.InList(path[len(path)-2], SupportedArches()) {
+		keep = 3
+	}
+	dst := strings.Join(path[len(path)-keep:], "/")
+	if ctx.Target().HostCross {
+		dst = "host-cross/" + dst
+	}
+	return dst
+}
+
+// Adds a file to testcasesContent, and reports an error if another file is
+// already copied to dst. Must be called with artTestMutex held.
+func addTestcasesEntry(ctx android.InstallHookContext, testcasesContent map[string]testcasesFile, dst, src string) {
+	if old, ok := testcasesContent[dst]; ok {
+		ctx.ModuleErrorf("Conflicting sources for %s: %s from module %s and %s from module %s",
+			dst, old.Src, old.Module, src, ctx.ModuleName())
+	}
+	testcasesContent[dst] = testcasesFile{Src: src, Module: ctx.ModuleName()}
+}
+
+// Copies the files listed in testcases_data_map of a host test next to the
+// test in the testcases directory.
+func addTestcasesData(ctx android.InstallHookContext, t *artTestProperties) {
+	if len(t.Testcases_data_map) == 0 {
+		return
+	}
+	if ctx.Os() != ctx.Config().BuildOS || ctx.Target().HostCross || ctx.Module().IsSkipInstall() {
+		return
+	}
+
+	testcasesContent := testcasesContent(ctx.Config())
+
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	dir := filepath.Dir(testcasesPath(ctx))
+	for _, entry := range t.Testcases_data_map {
+		src, dst, ok := strings.Cut(entry, ":")
+		if !ok || src == "" || dst == "" {
+			ctx.PropertyErrorf("testcases_data_map", "expected <src>:<dst>, got %q", entry)
+			continue
+		}
+		if !isRelativeTestcasesPath(dst) {
+			ctx.PropertyErrorf("testcases_data_map", "destination %q must be a relative path below the test", dst)
+			continue
+		}
+		dst = filepath.Join(dir, dst)
+		srcPath := android.PathForModuleSrc(ctx, src).String()
+		// The 32 and 64 bit variants of a test share the same data files.
+		if old, ok := testcasesContent[dst]; ok && old == (testcasesFile{Src: srcPath, Module: ctx.ModuleName()}) {
+			continue
+		}
+		addTestcasesEntry(ctx, testcasesContent, dst, srcPath)
+	}
+}
+
+// Returns whether path is a clean relative path that does not leave its base
+// directory.
+func isRelativeTestcasesPath(path string) bool {
+	return !filepath.IsAbs(path) && path == filepath.Clean(path) && path != ".." && !strings.HasPrefix(path, "../")
+}
+
+type testcasesDataProperties struct {
+	// Path of the file in the testcases directory, e.g. art/data/foo.txt.
+	Testcases_dst *string
+}
+
+// Like addTestcasesFile, but for data files that are copied to testcases_dst.
+func addTestcasesDataFile(ctx android.InstallHookContext, p *testcasesDataProperties) {
+	if ctx.Os() != ctx.Config().BuildOS || ctx.Target().HostCross || ctx.Module().IsSkipInstall() {
+		return
+	}
+
+	dst := proptools.String(p.Testcases_dst)
+	if dst == "" || !isRelativeTestcasesPath(dst) {
+		ctx.PropertyErrorf("testcases_dst", "must be a relative path, got %q", dst)
+		return
 	}
-	testcasesContent[dst] = src
+
+	testcasesContent := testcasesContent(ctx.Config())
+
+	artTestMutex.Lock()
+	defer artTestMutex.Unlock()
+
+	addTestcasesEntry(ctx, testcasesContent, dst, ctx.SrcPath().String())
+}
+
+func installTestcasesCustomizer(module android.Module) {
+	p := &testcasesProperties{}
+	android.AddInstallHook(module, func(ctx android.InstallHookContext) { addTestcasesFile(ctx, p) })
+	module.AddProperties(p)
 }
 
 var artTestMutex sync.Mutex
@@ -324,26 +2157,40 @@ var artTestMutex sync.Mutex
 func init() {
 	artModuleTypes := []string{
 		"art_cc_library",
+		"art_cc_library_host",
 		"art_cc_library_static",
 		"art_cc_binary",
 		"art_cc_test",
 		"art_cc_test_library",
+		"art_cc_fuzz",
+		"art_testcases_data",
 		"art_cc_defaults",
+		"art_debug_asserts_defaults",
 		"art_global_defaults",
 		"art_apex_test_host",
 	}
 	android.AddNeverAllowRules(
 		android.NeverAllow().
 			NotIn("art", "external/vixl").
-			ModuleType(artModuleTypes...))
+			ModuleType(artModuleTypes...).
+			Because("art_* module types are internal to ART, use the corresponding cc_* " +
+				"module types (e.g. cc_library instead of art_cc_library) outside of art/"))
+
+	registerArtBuildComponents(android.InitRegistrationContext)
+}
 
-	android.RegisterModuleType("art_cc_library", artLibrary)
-	android.RegisterModuleType("art_cc_library_static", artStaticLibrary)
-	android.RegisterModuleType("art_cc_binary", artBinary)
-	android.RegisterModuleType("art_cc_test", artTest)
-	android.RegisterModuleType("art_cc_test_library", artTestLibrary)
-	android.RegisterModuleType("art_cc_defaults", artDefaultsFactory)
-	android.RegisterModuleType("art_global_defaults", artGlobalDefaultsFactory)
+func registerArtBuildComponents(ctx android.RegistrationContext) {
+	ctx.RegisterModuleType("art_cc_library", artLibrary)
+	ctx.RegisterModuleType("art_cc_library_host", artHostLibrary)
+	ctx.RegisterModuleType("art_cc_library_static", artStaticLibrary)
+	ctx.RegisterModuleType("art_cc_binary", artBinary)
+	ctx.RegisterModuleType("art_cc_test", artTest)
+	ctx.RegisterModuleType("art_cc_test_library", artTestLibrary)
+	ctx.RegisterModuleType("art_cc_fuzz", artFuzz)
+	ctx.RegisterModuleType("art_testcases_data", artTestcasesData)
+	ctx.RegisterModuleType("art_cc_defaults", artDefaultsFactory)
+	ctx.RegisterModuleType("art_debug_asserts_defaults", artDebugAssertsDefaultsFactory)
+	ctx.RegisterModuleType("art_global_defaults", artGlobalDefaultsFactory)
 
 	// TODO: This makes the module disable itself for host if HOST_PREFER_32_BIT is
 	// set. We need this because the multilib types of binaries listed in the apex
@@ -351,7 +2198,7 @@ func init() {
 	// changes this to 'prefer32' on all host binaries. Since HOST_PREFER_32_BIT is
 	// only used for testing we can just disable the module.
 	// See b/120617876 for more information.
-	android.RegisterModuleType("art_apex_test_host", artHostTestApexBundleFactory)
+	ctx.RegisterModuleType("art_apex_test_host", artHostTestApexBundleFactory)
 }
 
 func artHostTestApexBundleFactory() android.Module {
@@ -380,25 +2227,95 @@ func artGlobalDefaultsFactory() android.Module {
 	module := artDefaultsFactory()
 	android.AddLoadHook(module, addImplicitFlags)
 	android.AddLoadHook(module, globalDefaults)
+	android.AddLoadHook(module, branchProtection)
+	android.AddLoadHook(module, cfProtection)
 
 	return module
 }
 
+// Hook that forces the DCHECKs on in the defaults shared by the debug variants
+// when ART_FORCE_ASSERTS selects them.
+func debugAsserts(ctx android.LoadHookContext) {
+	if forceAssertsMode(ctx) != "debug" {
+		return
+	}
+
+	type props struct {
+		Cflags  []string
+		Asflags []string
+	}
+
+	// The debug defaults undefine NDEBUG already, but repeat it so that the
+	// DCHECKs do not depend on the order of the flags.
+	p := &props{}
+	p.Cflags = []string{"-UNDEBUG", "-DART_FORCE_DCHECK=1"}
+	p.Asflags = []string{"-UNDEBUG"}
+	ctx.AppendProperties(p)
+}
+
 func artDefaultsFactory() android.Module {
 	c := &codegenProperties{}
-	module := cc.DefaultsFactory(c)
+	module := cc.DefaultsFactory(c, &testcasesProperties{})
 	android.AddLoadHook(module, func(ctx android.LoadHookContext) { codegen(ctx, c, staticAndSharedLibrary) })
 
 	return module
 }
 
+// Defaults with the flags that ART_FORCE_ASSERTS adds to the debug variants.
+// art_debug_defaults, a soong config module type, cannot have a load hook of
+// its own, so it lists these in its defaults.
+func artDebugAssertsDefaultsFactory() android.Module {
+	module := cc.DefaultsFactory()
+	android.AddLoadHook(module, debugAsserts)
+
+	return module
+}
+
 func artLibrary() android.Module {
 	module := cc.LibraryFactory()
 
 	installCodegenCustomizer(module, staticAndSharedLibrary)
 
-	android.AddLoadHook(module, addImplicitFlags)
-	android.AddInstallHook(module, addTestcasesFile)
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installHostOnlyCustomizer(module)
+	android.AddLoadHook(module, pgoInstrument)
+	android.AddLoadHook(module, deviceLinkerScript)
+	android.AddLoadHook(module, stripComment)
+	installTestcasesCustomizer(module)
+	return module
+}
+
+// Hook that restricts an art_cc_library_host to the host. Soong has no factory
+// for host libraries with both static and shared variants, so it is created as
+// a cc_library.
+func hostLibrary(ctx android.LoadHookContext) {
+	type props struct {
+		Host_supported   *bool
+		Device_supported *bool
+	}
+
+	p := &props{}
+	p.Host_supported = proptools.BoolPtr(true)
+	p.Device_supported = proptools.BoolPtr(false)
+	ctx.AppendProperties(p)
+}
+
+// Host-only variant of art_cc_library, for tools that are never built for the
+// device.
+func artHostLibrary() android.Module {
+	module := cc.LibraryFactory()
+	android.AddLoadHook(module, hostLibrary)
+
+	installCodegenCustomizer(module, hostStaticAndSharedLibrary)
+
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installTestcasesCustomizer(module)
 	return module
 }
 
@@ -407,17 +2324,28 @@ func artStaticLibrary() android.Module {
 
 	installCodegenCustomizer(module, staticLibrary)
 
-	android.AddLoadHook(module, addImplicitFlags)
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installHostOnlyCustomizer(module)
 	return module
 }
 
 func artBinary() android.Module {
 	module := cc.BinaryFactory()
 
-	android.AddLoadHook(module, addImplicitFlags)
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installHostOnlyCustomizer(module)
+	android.AddLoadHook(module, pgoInstrument)
+	android.AddLoadHook(module, deviceLinkerScript)
+	android.AddLoadHook(module, stripComment)
 	android.AddLoadHook(module, customLinker)
-	android.AddLoadHook(module, prefer32Bit)
-	android.AddInstallHook(module, addTestcasesFile)
+	installMultilibCustomizer(module)
+	installTestcasesCustomizer(module)
 	return module
 }
 
@@ -427,9 +2355,16 @@ func artTest() android.Module {
 
 	installCodegenCustomizer(module, binary)
 
-	android.AddLoadHook(module, addImplicitFlags)
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installHostOnlyCustomizer(module)
+	android.AddLoadHook(module, deviceLinkerScript)
+	android.AddLoadHook(module, stripComment)
 	android.AddLoadHook(module, customLinker)
-	android.AddLoadHook(module, prefer32Bit)
+	installMultilibCustomizer(module)
+	installTestCustomizer(module)
 	android.AddInstallHook(module, testInstall)
 	return module
 }
@@ -437,10 +2372,42 @@ func artTest() android.Module {
 func artTestLibrary() android.Module {
 	module := cc.TestLibraryFactory()
 
-	installCodegenCustomizer(module, staticAndSharedLibrary)
+	installTestLibraryCustomizer(module)
 
-	android.AddLoadHook(module, addImplicitFlags)
-	android.AddLoadHook(module, prefer32Bit)
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installHostOnlyCustomizer(module)
+	installMultilibCustomizer(module)
 	android.AddInstallHook(module, testInstall)
 	return module
 }
+
+// A host data file, e.g. the output of a genrule given as src, that tests need
+// in the testcases directory.
+func artTestcasesData() android.Module {
+	module := etc.PrebuiltEtcHostFactory()
+
+	p := &testcasesDataProperties{}
+	android.AddInstallHook(module, func(ctx android.InstallHookContext) { addTestcasesDataFile(ctx, p) })
+	module.AddProperties(p)
+	return module
+}
+
+func artFuzz() android.Module {
+	module := cc.LibFuzzFactory()
+
+	installCodegenCustomizer(module, binary)
+
+	installImplicitFlagsCustomizer(module)
+	installSanitizeRecoverCustomizer(module)
+	android.AddLoadHook(module, stackUsage)
+	android.AddLoadHook(module, o0Modules)
+	installHostOnlyCustomizer(module)
+	android.AddLoadHook(module, deviceLinkerScript)
+	android.AddLoadHook(module, stripComment)
+	android.AddLoadHook(module, customLinker)
+	installMultilibCustomizer(module)
+	return module
+}
@@ -0,0 +1,2504 @@
+// Copyright (C) 2023 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package art
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/blueprint/proptools"
+
+	"android/soong/android"
+	"android/soong/cc"
+)
+
+// The defaults that the ART modules of the tests use, like the ones in
+// art/build/Android.bp. The modules are defined in art/, since the neverallow
+// rule rejects ART module types elsewhere.
+const artDefaultsBp = `
+art_global_defaults {
+	name: "art_defaults",
+}
+
+art_debug_asserts_defaults {
+	name: "art_debug_asserts_defaults",
+}
+
+cc_defaults {
+	name: "art_debug_defaults",
+	defaults: [
+		"art_defaults",
+		"art_debug_asserts_defaults",
+	],
+}
+`
+
+// A library with both device and host variants.
+const libfooBp = `
+art_cc_library {
+	name: "libfoo",
+	defaults: ["art_defaults"],
+	host_supported: true,
+	srcs: ["foo.cc"],
+}
+`
+
+const (
+	deviceVariant       = "android_arm64_armv8-a"
+	deviceArmVariant    = "android_arm_armv7-a-neon"
+	hostVariant         = "linux_glibc_x86_64"
+	hostX86Variant      = "linux_glibc_x86"
+	deviceLibVariant    = deviceVariant + "_shared"
+	deviceArmLibVariant = deviceArmVariant + "_shared"
+	hostLibVariant      = hostVariant + "_shared"
+	hostX86LibVariant   = hostX86Variant + "_shared"
+)
+
+var prepareForArtTest = android.GroupFixturePreparers(
+	cc.PrepareForTestWithCcDefaultModules,
+	android.FixtureRegisterWithContext(registerArtBuildComponents),
+	android.FixtureRegisterWithContext(registerArtEnvSingletons),
+	android.FixtureMergeMockFs(android.MockFS{
+		"art/foo.cc":             nil,
+		"art/bar.cc":             nil,
+		"art/codegen_arm64.cc":   nil,
+		"art/codegen_riscv64.cc": nil,
+		"art/data/a.txt":         nil,
+		"art/data/b.txt":         nil,
+	}),
+)
+
+// Returns an environment with the given name and value pairs. Empty values are
+// left unset, so that test tables can use "" for unset variables.
+func envOf(pairs ...string) map[string]string {
+	env := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			env[pairs[i]] = pairs[i+1]
+		}
+	}
+	return env
+}
+
+func artFixture(env map[string]string, bp string, preparers ...android.FixturePreparer) android.FixturePreparer {
+	return android.GroupFixturePreparers(
+		prepareForArtTest,
+		android.FixtureMergeEnv(env),
+		android.GroupFixturePreparers(preparers...),
+		android.FixtureAddTextFile("art/Android.bp", artDefaultsBp+bp),
+	)
+}
+
+// Runs a test with the given environment and the modules in bp, which are
+// defined in art/Android.bp after the ART defaults.
+func runArtTest(t *testing.T, env map[string]string, bp string, preparers ...android.FixturePreparer) *android.TestResult {
+	t.Helper()
+	return artFixture(env, bp, preparers...).RunTest(t)
+}
+
+// Like runArtTest, but expects an error that matches pattern.
+func runArtErrorTest(t *testing.T, pattern string, env map[string]string, bp string, preparers ...android.FixturePreparer) {
+	t.Helper()
+	artFixture(env, bp, preparers...).
+		ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(pattern)).
+		RunTest(t)
+}
+
+// Returns the ArtConfig that art_defaults resolves from the given environment.
+// No ART module is built, so that the configuration can be tested as data.
+func artConfigForTest(t *testing.T, env map[string]string, preparers ...android.FixturePreparer) ArtConfig {
+	t.Helper()
+	result := runArtTest(t, env, "", preparers...)
+	return result.Config.Once(buildConfigKey, func() interface{} { return nil }).(ArtConfig)
+}
+
+// Sets SANITIZE_TARGET and SANITIZE_HOST. The sanitizer runtimes are not among
+// the default modules, so missing dependencies are allowed.
+func prepareForSanitizers(device, host []string) android.FixturePreparer {
+	return android.GroupFixturePreparers(
+		android.PrepareForTestWithAllowMissingDependencies,
+		android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+			variables.SanitizeDevice = device
+			variables.SanitizeHost = host
+		}),
+	)
+}
+
+// Sets the read barrier product variable, which ART_USE_READ_BARRIER can only
+// disable or force.
+func prepareForReadBarrier(enabled bool) android.FixturePreparer {
+	return android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+		variables.ArtUseReadBarrier = proptools.BoolPtr(enabled)
+	})
+}
+
+// Replaces the arm64 and arm device of the test config with an x86_64 one.
+var prepareForX86_64Device = android.FixtureModifyConfig(func(config android.Config) {
+	config.Targets[android.Android] = []android.Target{
+		{Os: android.Android, Arch: android.Arch{ArchType: android.X86_64}, NativeBridge: android.NativeBridgeDisabled},
+	}
+})
+
+// Adds a Windows host cross target. Its runtime libraries are not among the
+// default modules, so missing dependencies are allowed.
+var prepareForHostCross = android.GroupFixturePreparers(
+	android.PrepareForTestWithAllowMissingDependencies,
+	android.FixtureModifyConfig(func(config android.Config) {
+		config.Targets[android.Windows] = []android.Target{
+			{Os: android.Windows, Arch: android.Arch{ArchType: android.X86_64}, NativeBridge: android.NativeBridgeDisabled, HostCross: true},
+		}
+	}),
+)
+
+// Returns the cflags of the given module variant.
+func cflagsOf(result *android.TestResult, module, variant string) string {
+	return result.ModuleForTests(module, variant).Rule("cc").Args["cFlags"]
+}
+
+// Returns the ldflags of the given module variant.
+func ldflagsOf(result *android.TestResult, module, variant string) string {
+	return result.ModuleForTests(module, variant).Rule("ld").Args["ldFlags"]
+}
+
+// Returns the device and host cflags of libfoo.
+func libfooCflags(t *testing.T, env map[string]string, preparers ...android.FixturePreparer) (device string, host string) {
+	t.Helper()
+	result := runArtTest(t, env, libfooBp, preparers...)
+	return cflagsOf(result, "libfoo", deviceLibVariant), cflagsOf(result, "libfoo", hostLibVariant)
+}
+
+// Returns whether the space separated flags contain flag.
+func hasFlag(flags, flag string) bool {
+	return android.InList(flag, strings.Fields(flags))
+}
+
+// Returns the number of times flag appears in the space separated flags.
+func countFlag(flags, flag string) int {
+	n := 0
+	for _, f := range strings.Fields(flags) {
+		if f == flag {
+			n++
+		}
+	}
+	return n
+}
+
+var optFlagRegexp = regexp.MustCompile(`^-O[0-9sz]?$`)
+
+// Returns the last optimization level flag in the space separated flags,
+// which is the one that takes effect.
+func lastOptFlag(flags string) string {
+	last := ""
+	for _, f := range strings.Fields(flags) {
+		if optFlagRegexp.MatchString(f) {
+			last = f
+		}
+	}
+	return last
+}
+
+// Returns the variants of the module whose names start with prefix, sorted.
+func variantsWithPrefix(result *android.TestResult, module, prefix string) []string {
+	var variants []string
+	for _, variant := range result.ModuleVariantsForTests(module) {
+		if strings.HasPrefix(variant, prefix) {
+			variants = append(variants, variant)
+		}
+	}
+	sort.Strings(variants)
+	return variants
+}
+
+// Asserts that the flags in want appear in got in the same order, possibly with
+// other flags in between.
+func assertSubsequence(t *testing.T, message string, want, got []string) {
+	t.Helper()
+	i := 0
+	for _, flag := range got {
+		if i < len(want) && flag == want[i] {
+			i++
+		}
+	}
+	if i < len(want) {
+		t.Errorf("%s: %q not found in order in %q", message, want[i:], got)
+	}
+}
+
+// Asserts that s matches the regular expression pattern.
+func assertMatches(t *testing.T, message, s, pattern string) {
+	t.Helper()
+	if !regexp.MustCompile(pattern).MatchString(s) {
+		t.Errorf("%s: %q does not match %q", message, s, pattern)
+	}
+}
+
+// Returns whether the given module variant exists and has a rule named rule.
+func hasRule(result *android.TestResult, module, variant, rule string) bool {
+	if !android.InList(variant, result.ModuleVariantsForTests(module)) {
+		return false
+	}
+	return result.ModuleForTests(module, variant).MaybeRule(rule).Rule != nil
+}
+
+// Captures the log output of the test, which has the warnings of the hooks.
+// Resets the warnings that are only logged once per build.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	ltoWarningOnce = sync.Once{}
+	customLinkerWarningOnce = sync.Once{}
+	d8DesugarLogOnce = sync.Once{}
+	targetLinuxWarningOnce = sync.Once{}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// The global flags must stay exactly the same as before they were derived from
+// ArtConfig, which is what globalFlags emitted when it read the environment
+// itself.
+func TestGlobalFlagsGolden(t *testing.T) {
+	defaultGaps := []string{
+		"-DART_STACK_OVERFLOW_GAP_arm=8192",
+		"-DART_STACK_OVERFLOW_GAP_arm64=8192",
+		"-DART_STACK_OVERFLOW_GAP_riscv64=8192",
+		"-DART_STACK_OVERFLOW_GAP_x86=8192",
+		"-DART_STACK_OVERFLOW_GAP_x86_64=8192",
+	}
+	sanitizedGaps := []string{
+		"-DART_STACK_OVERFLOW_GAP_arm=16384",
+		"-DART_STACK_OVERFLOW_GAP_arm64=16384",
+		"-DART_STACK_OVERFLOW_GAP_riscv64=16384",
+		"-DART_STACK_OVERFLOW_GAP_x86=16384",
+		"-DART_STACK_OVERFLOW_GAP_x86_64=20480",
+	}
+	concat := func(lists ...[]string) []string {
+		var ret []string
+		for _, l := range lists {
+			ret = append(ret, l...)
+		}
+		return ret
+	}
+
+	testCases := []struct {
+		name         string
+		env          map[string]string
+		readBarrier  bool
+		sanitizeHost []string
+		cflags       []string
+	}{
+		{
+			name: "default",
+			env:  envOf(),
+			cflags: concat(
+				[]string{
+					"-O3",
+					"-DART_DEFAULT_GC_TYPE_IS_CMC",
+					"-DART_CXX_INTERPRETER_ENABLED=0",
+					`-DART_RB_GEN_CONFIG="none"`,
+					`-DART_READ_BARRIER_TYPE_NAME="none"`,
+					"-DART_GENERATIONAL_IMPLIED_BY_RB=0",
+					"-DART_USE_TLAB=1",
+					"-DART_DEFAULT_COMPACT_DEX_LEVEL=fast",
+				},
+				defaultGaps,
+				[]string{"-DART_MIN_FRAME_SIZE_LIMIT=1736", "-DUSE_D8_DESUGAR=1"}),
+		},
+		{
+			name:        "forced read barrier with heap poisoning",
+			env:         envOf("ART_USE_READ_BARRIER", "true", "ART_HEAP_POISONING", "true", "ART_DEFAULT_GC_TYPE", "CMS"),
+			readBarrier: true,
+			cflags: concat(
+				[]string{
+					"-O3",
+					"-DART_DEFAULT_GC_TYPE_IS_CMS",
+					"-DART_HEAP_POISONING=1",
+					"-DART_CXX_INTERPRETER_ENABLED=0",
+					"-DART_USE_READ_BARRIER=1",
+					"-DART_READ_BARRIER_TYPE_IS_BAKER=1",
+					"-DART_USE_GENERATIONAL_CC=1",
+					"-DART_FORCE_USE_READ_BARRIER=1",
+					`-DART_RB_GEN_CONFIG="baker+gen"`,
+					`-DART_READ_BARRIER_TYPE_NAME="baker"`,
+					"-DART_GENERATIONAL_IMPLIED_BY_RB=1",
+					"-DART_USE_TLAB=1",
+					"-DART_DEFAULT_COMPACT_DEX_LEVEL=fast",
+				},
+				defaultGaps,
+				[]string{"-DART_MIN_FRAME_SIZE_LIMIT=1736", "-DUSE_D8_DESUGAR=1"}),
+		},
+		{
+			name: "debug GC on a sanitized host",
+			env: envOf(
+				"ART_TEST_DEBUG_GC", "true",
+				"ART_NDEBUG_OPT_FLAG", "-O2",
+				"ART_USE_CXX_INTERPRETER", "true",
+				"ART_READ_BARRIER_TYPE", "TABLELOOKUP",
+				"ART_USE_GENERATIONAL_CC", "false",
+				"ART_DEFAULT_COMPACT_DEX_LEVEL", "none",
+				"USE_D8_DESUGAR", "false"),
+			readBarrier:  true,
+			sanitizeHost: []string{"address"},
+			cflags: concat(
+				[]string{
+					"-O2",
+					"-DART_DEFAULT_GC_TYPE_IS_SS",
+					"-DART_USE_CXX_INTERPRETER=1",
+					"-DART_CXX_INTERPRETER_ENABLED=1",
+					"-DART_USE_READ_BARRIER=1",
+					"-DART_READ_BARRIER_TYPE_IS_TABLELOOKUP=1",
+					`-DART_RB_GEN_CONFIG="tablelookup"`,
+					`-DART_READ_BARRIER_TYPE_NAME="tablelookup"`,
+					"-DART_GENERATIONAL_IMPLIED_BY_RB=0",
+					"-DART_USE_TLAB=1",
+					"-DART_DEFAULT_COMPACT_DEX_LEVEL=none",
+				},
+				sanitizedGaps,
+				[]string{"-DART_MIN_FRAME_SIZE_LIMIT=1736"}),
+		},
+		{
+			name: "CMS with read barriers disabled and full ASAN",
+			env: envOf(
+				"ART_DEFAULT_GC_TYPE", "CMS",
+				"ART_USE_READ_BARRIER", "false",
+				"ART_ENABLE_ADDRESS_SANITIZER", "true"),
+			readBarrier: true,
+			cflags: concat(
+				[]string{
+					"-O3",
+					"-DART_DEFAULT_GC_TYPE_IS_CMS",
+					"-DART_CXX_INTERPRETER_ENABLED=0",
+					`-DART_RB_GEN_CONFIG="none"`,
+					`-DART_READ_BARRIER_TYPE_NAME="none"`,
+					"-DART_GENERATIONAL_IMPLIED_BY_RB=0",
+					"-DART_DEFAULT_COMPACT_DEX_LEVEL=fast",
+				},
+				defaultGaps,
+				[]string{
+					"-DART_MIN_FRAME_SIZE_LIMIT=1736",
+					"-DART_ENABLE_ADDRESS_SANITIZER=1",
+					"-DUSE_D8_DESUGAR=1",
+				}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device, _ := libfooCflags(t, tc.env,
+				prepareForReadBarrier(tc.readBarrier),
+				prepareForSanitizers(nil, tc.sanitizeHost))
+			android.AssertStringDoesContain(t, "global cflags", device, strings.Join(tc.cflags, " "))
+		})
+	}
+}
+
+// Like TestGlobalFlagsGolden, for the target flags of the default environment.
+func TestTargetFlagsGolden(t *testing.T) {
+	result := runArtTest(t, envOf(), libfooBp)
+	config := result.Config
+
+	deltas := []string{
+		"-DART_BASE_ADDRESS_MIN_DELTA=(-0x1000000)",
+		"-DART_BASE_ADDRESS_MAX_DELTA=0x1000000",
+		"-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=1",
+	}
+	testCases := []struct {
+		name    string
+		variant string
+		cflags  []string
+	}{
+		{
+			name:    "device",
+			variant: deviceLibVariant,
+			cflags: append(append([]string{
+				"-DART_SIZE_OPTIMIZED=0",
+				"-Wframe-larger-than=1736",
+				"-DART_FRAME_SIZE_LIMIT=1736",
+				"-DART_BASE_ADDRESS=" + config.LibartImgDeviceBaseAddress(),
+			}, deltas...),
+				`-DART_DEFAULT_BOOT_IMAGE_LOCATION="/apex/com.android.art/javalib/boot.art"`,
+				clangPathFlag(config),
+				clangPathHashFlag(config)),
+		},
+		{
+			name:    "host",
+			variant: hostLibVariant,
+			cflags: append(append([]string{
+				"-DART_SIZE_OPTIMIZED=0",
+				"-Wframe-larger-than=1736",
+				"-DART_FRAME_SIZE_LIMIT=1736",
+				"-DART_BASE_ADDRESS=" + config.LibartImgHostBaseAddress(),
+			}, deltas...),
+				`-DART_DEFAULT_BOOT_IMAGE_LOCATION="apex/art_boot_images/javalib/boot.art"`,
+				clangPathFlag(config),
+				clangPathHashFlag(config),
+				fmt.Sprintf(`-DART_HOST_PREBUILT_OS="%s"`, config.PrebuiltOS())),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cflags := cflagsOf(result, "libfoo", tc.variant)
+			android.AssertStringDoesContain(t, "target cflags", cflags, strings.Join(tc.cflags, " "))
+		})
+	}
+}
+
+// ART_USE_GENERATIONAL_GC replaces ART_USE_GENERATIONAL_CC, which still works
+// with a deprecation warning.
+func TestGenerationalEnvTable(t *testing.T) {
+	testCases := []struct {
+		gc, cc       string
+		generational bool
+		err          string
+	}{
+		{gc: "", cc: "", generational: true},
+		{gc: "", cc: "true", generational: true},
+		{gc: "", cc: "false", generational: false},
+		{gc: "true", cc: "", generational: true},
+		{gc: "true", cc: "true", generational: true},
+		{gc: "true", cc: "false", err: "Conflicting values for ART_USE_GENERATIONAL_GC and ART_USE_GENERATIONAL_CC"},
+		{gc: "false", cc: "", generational: false},
+		{gc: "false", cc: "true", err: "Conflicting values for ART_USE_GENERATIONAL_GC and ART_USE_GENERATIONAL_CC"},
+		{gc: "false", cc: "false", generational: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("GC=%q,CC=%q", tc.gc, tc.cc), func(t *testing.T) {
+			env := envOf("ART_USE_GENERATIONAL_GC", tc.gc, "ART_USE_GENERATIONAL_CC", tc.cc)
+			if tc.err != "" {
+				runArtErrorTest(t, tc.err, env, "", prepareForReadBarrier(true))
+				return
+			}
+
+			logs := captureLog(t)
+			device, _ := libfooCflags(t, env, prepareForReadBarrier(true))
+			android.AssertBoolEquals(t, "-DART_USE_GENERATIONAL_CC=1", tc.generational,
+				hasFlag(device, "-DART_USE_GENERATIONAL_CC=1"))
+
+			// Only the deprecated variable warns.
+			warning := "ART_USE_GENERATIONAL_CC is deprecated, use ART_USE_GENERATIONAL_GC instead"
+			if tc.cc != "" {
+				android.AssertStringDoesContain(t, "log", logs.String(), warning)
+			} else {
+				android.AssertStringDoesNotContain(t, "log", logs.String(), warning)
+			}
+		})
+	}
+}
+
+func TestBuildProfile(t *testing.T) {
+	t.Run("benchmark", func(t *testing.T) {
+		c := artConfigForTest(t, envOf("ART_BUILD_PROFILE", "benchmark"))
+		cflags, _ := globalFlags(c)
+		android.AssertDeepEquals(t, "leading cflags",
+			[]string{"-fno-omit-frame-pointer", "-O3", "-DART_DEFAULT_GC_TYPE_IS_CMC"}, cflags[:3])
+		android.AssertStringListDoesNotContain(t, "cflags", cflags, "-DART_USE_GENERATIONAL_GC=1")
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		c := artConfigForTest(t, envOf(
+			"ART_BUILD_PROFILE", "benchmark",
+			"ART_NDEBUG_OPT_FLAG", "-O2",
+			"ART_DEFAULT_GC_TYPE", "CMS",
+			"ART_KEEP_FRAME_POINTERS", "false"))
+		cflags, _ := globalFlags(c)
+		android.AssertDeepEquals(t, "leading cflags", []string{"-O2", "-DART_DEFAULT_GC_TYPE_IS_CMS"}, cflags[:2])
+		android.AssertStringListDoesNotContain(t, "cflags", cflags, "-fno-omit-frame-pointer")
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		runArtErrorTest(t, `Unknown ART_BUILD_PROFILE "fast", expected one of benchmark`,
+			envOf("ART_BUILD_PROFILE", "fast"), "")
+	})
+
+	t.Run("sanitizers", func(t *testing.T) {
+		runArtErrorTest(t, "Sanitizers cannot be enabled in the ART benchmark build profile, got address",
+			envOf("ART_BUILD_PROFILE", "benchmark"), "", prepareForSanitizers([]string{"address"}, nil))
+	})
+}
+
+// The read barrier and generational defines must match the decisions across
+// the GC paths.
+func TestReadBarrierGenerationalDefines(t *testing.T) {
+	testCases := []struct {
+		name        string
+		env         map[string]string
+		readBarrier bool
+		rbGen       string
+		typeName    string
+		implied     bool
+		want        []string
+	}{
+		{
+			name:        "read barrier from the product",
+			env:         envOf(),
+			readBarrier: true,
+			rbGen:       "baker+gen",
+			typeName:    "baker",
+			want:        []string{"-DART_USE_GENERATIONAL_CC=1"},
+		},
+		{
+			name:        "forced read barrier",
+			env:         envOf("ART_USE_READ_BARRIER", "true", "ART_DEFAULT_GC_TYPE", "CMS"),
+			readBarrier: true,
+			rbGen:       "baker+gen",
+			typeName:    "baker",
+			implied:     true,
+			want:        []string{"-DART_USE_GENERATIONAL_CC=1", "-DART_FORCE_USE_READ_BARRIER=1"},
+		},
+		{
+			name:        "forced read barrier with explicit generational GC",
+			env:         envOf("ART_USE_READ_BARRIER", "true", "ART_DEFAULT_GC_TYPE", "CMS", "ART_USE_GENERATIONAL_GC", "true"),
+			readBarrier: true,
+			rbGen:       "baker+gen",
+			typeName:    "baker",
+		},
+		{
+			name:        "read barrier without generational CC",
+			env:         envOf("ART_USE_GENERATIONAL_CC", "false"),
+			readBarrier: true,
+			rbGen:       "baker",
+			typeName:    "baker",
+		},
+		{
+			name:        "table lookup read barrier",
+			env:         envOf("ART_READ_BARRIER_TYPE", "TABLELOOKUP", "ART_USE_GENERATIONAL_CC", "false"),
+			readBarrier: true,
+			rbGen:       "tablelookup",
+			typeName:    "tablelookup",
+		},
+		{
+			name:        "read barrier disabled",
+			env:         envOf("ART_USE_READ_BARRIER", "false"),
+			readBarrier: true,
+			rbGen:       "none",
+			typeName:    "none",
+		},
+		{
+			name:     "CMC",
+			env:      envOf(),
+			rbGen:    "none",
+			typeName: "none",
+		},
+		{
+			name:     "generational CMC",
+			env:      envOf("ART_USE_GENERATIONAL_GC", "true"),
+			rbGen:    "none",
+			typeName: "none",
+			want:     []string{"-DART_USE_GENERATIONAL_GC=1"},
+		},
+		{
+			name:     "GENCMC",
+			env:      envOf("ART_DEFAULT_GC_TYPE", "GENCMC"),
+			rbGen:    "none",
+			typeName: "none",
+			want:     []string{"-DART_USE_GENERATIONAL_GC=1"},
+		},
+		{
+			name:     "CMS",
+			env:      envOf("ART_DEFAULT_GC_TYPE", "CMS", "ART_USE_GENERATIONAL_GC", "true"),
+			rbGen:    "none",
+			typeName: "none",
+		},
+		{
+			name:     "debug GC",
+			env:      envOf("ART_TEST_DEBUG_GC", "true"),
+			rbGen:    "none",
+			typeName: "none",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device, _ := libfooCflags(t, tc.env, prepareForReadBarrier(tc.readBarrier))
+			android.AssertBoolEquals(t, "ART_RB_GEN_CONFIG", true,
+				hasFlag(device, fmt.Sprintf(`-DART_RB_GEN_CONFIG="%s"`, tc.rbGen)))
+			android.AssertBoolEquals(t, "ART_READ_BARRIER_TYPE_NAME", true,
+				hasFlag(device, fmt.Sprintf(`-DART_READ_BARRIER_TYPE_NAME="%s"`, tc.typeName)))
+			implied := "-DART_GENERATIONAL_IMPLIED_BY_RB=0"
+			if tc.implied {
+				implied = "-DART_GENERATIONAL_IMPLIED_BY_RB=1"
+			}
+			android.AssertBoolEquals(t, implied, true, hasFlag(device, implied))
+			for _, flag := range tc.want {
+				android.AssertBoolEquals(t, flag, true, hasFlag(device, flag))
+			}
+		})
+	}
+}
+
+func TestGcTypeValidation(t *testing.T) {
+	for _, gcType := range supportedGcTypes {
+		t.Run(gcType, func(t *testing.T) {
+			device, _ := libfooCflags(t, envOf("ART_DEFAULT_GC_TYPE", gcType))
+			android.AssertBoolEquals(t, "-DART_DEFAULT_GC_TYPE_IS_"+gcType, true,
+				hasFlag(device, "-DART_DEFAULT_GC_TYPE_IS_"+gcType))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		runArtErrorTest(t, `Unknown ART_DEFAULT_GC_TYPE "CCM", expected one of CMC, CMS, GENCMC, SS`,
+			envOf("ART_DEFAULT_GC_TYPE", "CCM"), "")
+	})
+
+	// The debug GC overrides the GC type, so it is not checked.
+	t.Run("unknown with debug GC", func(t *testing.T) {
+		device, _ := libfooCflags(t, envOf("ART_DEFAULT_GC_TYPE", "CCM", "ART_TEST_DEBUG_GC", "true"))
+		android.AssertBoolEquals(t, "-DART_DEFAULT_GC_TYPE_IS_SS", true, hasFlag(device, "-DART_DEFAULT_GC_TYPE_IS_SS"))
+	})
+}
+
+func TestGenCmc(t *testing.T) {
+	c := artConfigForTest(t, envOf("ART_DEFAULT_GC_TYPE", "GENCMC"))
+	android.AssertBoolEquals(t, "Tlab", true, c.Tlab)
+	// The generational define is only a placeholder, so GENCMC is not reported
+	// as generational.
+	android.AssertBoolEquals(t, "GenerationalCmcPlaceholder", true, c.GenerationalCmcPlaceholder)
+	android.AssertBoolEquals(t, "Generational", false, c.Generational)
+	cflags, _ := globalFlags(c)
+	for _, flag := range []string{
+		"-DART_DEFAULT_GC_TYPE_IS_CMC",
+		"-DART_DEFAULT_GC_TYPE_IS_GENCMC",
+		"-DART_USE_GENERATIONAL_GC=1",
+		"-DART_USE_TLAB=1",
+		`-DART_RB_GEN_CONFIG="none"`,
+	} {
+		android.AssertStringListContains(t, "cflags", cflags, flag)
+	}
+
+	runArtErrorTest(t, "ART_DEFAULT_GC_TYPE=GENCMC cannot be used with ART_USE_GENERATIONAL_GC=false",
+		envOf("ART_DEFAULT_GC_TYPE", "GENCMC", "ART_USE_GENERATIONAL_GC", "false"), "")
+	runArtErrorTest(t, "ART_DEFAULT_GC_TYPE=GENCMC cannot be used with ART_USE_READ_BARRIER=true",
+		envOf("ART_DEFAULT_GC_TYPE", "GENCMC", "ART_USE_READ_BARRIER", "true"), "", prepareForReadBarrier(true))
+}
+
+func TestReadBarrierTypeValidation(t *testing.T) {
+	for _, barrierType := range []string{"BAKER", "TABLELOOKUP"} {
+		t.Run(barrierType, func(t *testing.T) {
+			device, _ := libfooCflags(t, envOf("ART_READ_BARRIER_TYPE", barrierType), prepareForReadBarrier(true))
+			android.AssertBoolEquals(t, "cflags", true, hasFlag(device, "-DART_READ_BARRIER_TYPE_IS_"+barrierType+"=1"))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		runArtErrorTest(t, `Unknown ART_READ_BARRIER_TYPE "BROOKS", expected one of BAKER, TABLELOOKUP`,
+			envOf("ART_READ_BARRIER_TYPE", "BROOKS"), "", prepareForReadBarrier(true))
+	})
+
+	// The type is only used with read barriers.
+	t.Run("unknown without read barriers", func(t *testing.T) {
+		runArtTest(t, envOf("ART_READ_BARRIER_TYPE", "BROOKS"), libfooBp, prepareForReadBarrier(false))
+	})
+
+	t.Run("forced with CMC", func(t *testing.T) {
+		runArtErrorTest(t, "ART_DEFAULT_GC_TYPE=CMC cannot be used with ART_USE_READ_BARRIER=true",
+			envOf("ART_USE_READ_BARRIER", "true", "ART_DEFAULT_GC_TYPE", "CMC"), "", prepareForReadBarrier(true))
+	})
+
+	// CMC is also the default GC type, and the one of the benchmark profile.
+	t.Run("forced with the default CMC", func(t *testing.T) {
+		runArtErrorTest(t, "ART_DEFAULT_GC_TYPE=CMC cannot be used with ART_USE_READ_BARRIER=true",
+			envOf("ART_USE_READ_BARRIER", "true"), "", prepareForReadBarrier(true))
+	})
+
+	t.Run("forced with the benchmark profile", func(t *testing.T) {
+		runArtErrorTest(t, "ART_DEFAULT_GC_TYPE=CMC cannot be used with ART_USE_READ_BARRIER=true",
+			envOf("ART_USE_READ_BARRIER", "true", "ART_BUILD_PROFILE", "benchmark"), "", prepareForReadBarrier(true))
+	})
+
+	// The debug GC replaces the GC type.
+	t.Run("forced with the debug GC", func(t *testing.T) {
+		runArtTest(t, envOf("ART_USE_READ_BARRIER", "true", "ART_DEFAULT_GC_TYPE", "CMC", "ART_TEST_DEBUG_GC", "true"),
+			libfooBp, prepareForReadBarrier(true))
+	})
+}
+
+// The host prebuilt OS is only defined on host, and can be overridden.
+func TestHostPrebuiltOS(t *testing.T) {
+	result := runArtTest(t, envOf(), libfooBp)
+	host := cflagsOf(result, "libfoo", hostLibVariant)
+	android.AssertBoolEquals(t, "host define", true,
+		hasFlag(host, fmt.Sprintf(`-DART_HOST_PREBUILT_OS="%s"`, result.Config.PrebuiltOS())))
+	device := cflagsOf(result, "libfoo", deviceLibVariant)
+	android.AssertStringDoesNotContain(t, "device cflags", device, "-DART_HOST_PREBUILT_OS")
+
+	_, host = libfooCflags(t, envOf("ART_CLANG_PREBUILT_OS", "linux-arm64"))
+	android.AssertBoolEquals(t, "overridden define", true, hasFlag(host, `-DART_HOST_PREBUILT_OS="linux-arm64"`))
+}
+
+func TestClangPath(t *testing.T) {
+	result := runArtTest(t, envOf(), libfooBp)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		cflags := cflagsOf(result, "libfoo", variant)
+		android.AssertBoolEquals(t, variant+" ART_CLANG_PATH", true, hasFlag(cflags, clangPathFlag(result.Config)))
+		android.AssertBoolEquals(t, variant+" ART_CLANG_PATH_HASH", true, hasFlag(cflags, clangPathHashFlag(result.Config)))
+	}
+}
+
+func TestClangPathHash(t *testing.T) {
+	config := android.TestConfig(t.TempDir(), nil, "", nil)
+	android.AssertStringEquals(t, "hash of the same path", clangPathHashFlag(config), clangPathHashFlag(config))
+	assertMatches(t, "hash", clangPathHashFlag(config), `^-DART_CLANG_PATH_HASH="[0-9a-f]{8}"$`)
+
+	otherConfig := android.TestConfig(t.TempDir(), map[string]string{"ART_CLANG_PREBUILT_OS": "linux-arm64"}, "", nil)
+	if clangPathHashFlag(config) == clangPathHashFlag(otherConfig) {
+		t.Errorf("expected different hashes for %q and %q", artClangPath(config), artClangPath(otherConfig))
+	}
+}
+
+func TestBuildConfigHash(t *testing.T) {
+	result := runArtTest(t, envOf("ART_HEAP_POISONING", "true"), libfooBp)
+	want := fmt.Sprintf(`-DART_BUILD_CONFIG_HASH="%s"`, artEnvHash(result.Config))
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		android.AssertBoolEquals(t, variant+" "+want, true, hasFlag(cflagsOf(result, "libfoo", variant), want))
+	}
+}
+
+func TestOptFlags(t *testing.T) {
+	testCases := []struct {
+		opt, want string
+	}{
+		{opt: "", want: "-DART_SIZE_OPTIMIZED=0"},
+		{opt: "-O2", want: "-DART_SIZE_OPTIMIZED=0"},
+		{opt: "-Os", want: "-DART_SIZE_OPTIMIZED=1"},
+		{opt: "-Oz", want: "-DART_SIZE_OPTIMIZED=1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.opt), func(t *testing.T) {
+			device, host := libfooCflags(t, envOf("ART_NDEBUG_OPT_FLAG", tc.opt))
+			android.AssertBoolEquals(t, "device "+tc.want, true, hasFlag(device, tc.want))
+			android.AssertBoolEquals(t, "host "+tc.want, true, hasFlag(host, tc.want))
+		})
+	}
+}
+
+func TestKeepFramePointers(t *testing.T) {
+	defaultDevice, defaultHost := libfooCflags(t, envOf())
+	for _, value := range []string{"", "false", "true"} {
+		t.Run(fmt.Sprintf("%q", value), func(t *testing.T) {
+			extra := 0
+			if value == "true" {
+				extra = 1
+			}
+			device, host := libfooCflags(t, envOf("ART_KEEP_FRAME_POINTERS", value))
+			android.AssertIntEquals(t, "device -fno-omit-frame-pointer",
+				countFlag(defaultDevice, "-fno-omit-frame-pointer")+extra, countFlag(device, "-fno-omit-frame-pointer"))
+			android.AssertIntEquals(t, "host -fno-omit-frame-pointer",
+				countFlag(defaultHost, "-fno-omit-frame-pointer")+extra, countFlag(host, "-fno-omit-frame-pointer"))
+		})
+	}
+}
+
+func TestOptFlagOverrides(t *testing.T) {
+	testCases := []struct {
+		name         string
+		env          map[string]string
+		device, host string
+	}{
+		{
+			name:   "default",
+			env:    envOf(),
+			device: "-O3",
+			host:   "-O3",
+		},
+		{
+			name:   "fallback",
+			env:    envOf("ART_NDEBUG_OPT_FLAG", "-O2"),
+			device: "-O2",
+			host:   "-O2",
+		},
+		{
+			name:   "per target",
+			env:    envOf("ART_NDEBUG_OPT_FLAG", "-O2", "ART_NDEBUG_OPT_FLAG_DEVICE", "-Os", "ART_NDEBUG_OPT_FLAG_HOST", "-O3"),
+			device: "-Os",
+			host:   "-O3",
+		},
+		{
+			name:   "device only",
+			env:    envOf("ART_NDEBUG_OPT_FLAG_DEVICE", "-O2"),
+			device: "-O2",
+			host:   "-O3",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device, host := libfooCflags(t, tc.env)
+			android.AssertStringEquals(t, "device opt flag", tc.device, lastOptFlag(device))
+			android.AssertStringEquals(t, "host opt flag", tc.host, lastOptFlag(host))
+		})
+	}
+}
+
+func TestFrameSizeLimits(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		device, host := libfooCflags(t, envOf())
+		for _, cflags := range []string{device, host} {
+			android.AssertStringDoesContain(t, "cflags", cflags, "-Wframe-larger-than=1736 -DART_FRAME_SIZE_LIMIT=1736")
+			android.AssertBoolEquals(t, "-Werror=frame-larger-than", false, hasFlag(cflags, "-Werror=frame-larger-than"))
+		}
+	})
+
+	t.Run("overrides", func(t *testing.T) {
+		device, host := libfooCflags(t, envOf("ART_DEVICE_FRAME_SIZE_LIMIT", "2000", "ART_HOST_FRAME_SIZE_LIMIT", "3000"))
+		android.AssertStringDoesContain(t, "device cflags", device, "-Wframe-larger-than=2000 -DART_FRAME_SIZE_LIMIT=2000")
+		android.AssertStringDoesContain(t, "host cflags", host, "-Wframe-larger-than=3000 -DART_FRAME_SIZE_LIMIT=3000")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		device, host := libfooCflags(t, envOf("ART_FRAME_SIZE_ERROR", "true"))
+		for _, cflags := range []string{device, host} {
+			android.AssertBoolEquals(t, "-Werror=frame-larger-than", true, hasFlag(cflags, "-Werror=frame-larger-than"))
+		}
+	})
+
+	t.Run("sanitized defaults", func(t *testing.T) {
+		c := artConfigForTest(t, envOf(), prepareForSanitizers([]string{"address"}, []string{"address"}))
+		android.AssertIntEquals(t, "DeviceFrameSizeLimit", 7400, c.DeviceFrameSizeLimit)
+		android.AssertIntEquals(t, "HostFrameSizeLimit", 10000, c.HostFrameSizeLimit)
+	})
+
+	t.Run("sanitized overrides", func(t *testing.T) {
+		c := artConfigForTest(t, envOf("ART_DEVICE_FRAME_SIZE_LIMIT", "8000", "ART_HOST_FRAME_SIZE_LIMIT", "12000"),
+			prepareForSanitizers([]string{"address"}, []string{"address"}))
+		android.AssertIntEquals(t, "DeviceFrameSizeLimit", 8000, c.DeviceFrameSizeLimit)
+		android.AssertIntEquals(t, "HostFrameSizeLimit", 12000, c.HostFrameSizeLimit)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		runArtErrorTest(t, `ART_HOST_FRAME_SIZE_LIMIT must be a positive integer, got "big"`,
+			envOf("ART_HOST_FRAME_SIZE_LIMIT", "big"), "")
+	})
+
+	t.Run("above the stack overflow gap", func(t *testing.T) {
+		runArtErrorTest(t, "The host frame size limit 9000 must be less than the stack overflow gap 8192 of arm",
+			envOf("ART_HOST_FRAME_SIZE_LIMIT", "9000"), "")
+	})
+}
+
+func TestFrameSizeFlags(t *testing.T) {
+	android.AssertDeepEquals(t, "warnings",
+		[]string{"-Wframe-larger-than=1736", "-DART_FRAME_SIZE_LIMIT=1736"},
+		frameSizeFlags(ArtConfig{}, 1736))
+	android.AssertDeepEquals(t, "errors",
+		[]string{"-Wframe-larger-than=7400", "-DART_FRAME_SIZE_LIMIT=7400", "-Werror=frame-larger-than"},
+		frameSizeFlags(ArtConfig{FrameSizeError: true}, 7400))
+}
+
+// ART_MIN_FRAME_SIZE_LIMIT is the tightest of the host and device frame size
+// limits, and unlike ART_FRAME_SIZE_LIMIT the same on all variants.
+func TestMinFrameSizeLimit(t *testing.T) {
+	testCases := []struct {
+		name         string
+		env          map[string]string
+		device, host []string
+		want         int
+	}{
+		{name: "default", env: envOf(), want: 1736},
+		{name: "sanitized host", env: envOf(), host: []string{"address"}, want: 1736},
+		{name: "sanitized device", env: envOf(), device: []string{"address"}, want: 1736},
+		{name: "sanitized device and host", env: envOf(), device: []string{"address"}, host: []string{"address"}, want: 7400},
+		{name: "lower host limit", env: envOf("ART_DEVICE_FRAME_SIZE_LIMIT", "4000", "ART_HOST_FRAME_SIZE_LIMIT", "3000"), want: 3000},
+		{name: "lower device limit", env: envOf("ART_DEVICE_FRAME_SIZE_LIMIT", "2000", "ART_HOST_FRAME_SIZE_LIMIT", "3000"), want: 2000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device, host := libfooCflags(t, tc.env, prepareForSanitizers(tc.device, tc.host))
+			want := fmt.Sprintf("-DART_MIN_FRAME_SIZE_LIMIT=%d", tc.want)
+			android.AssertBoolEquals(t, "device "+want, true, hasFlag(device, want))
+			android.AssertBoolEquals(t, "host "+want, true, hasFlag(host, want))
+		})
+	}
+}
+
+func TestSanitizerFrameSizeLimits(t *testing.T) {
+	testCases := []struct {
+		name       string
+		env        map[string]string
+		sanitizers []string
+		want       int
+	}{
+		{
+			name:       "address",
+			env:        envOf("ART_DEVICE_FRAME_SIZE_LIMIT_hwaddress", "4096"),
+			sanitizers: []string{"address"},
+			want:       7400,
+		},
+		{
+			name:       "hwaddress",
+			env:        envOf("ART_DEVICE_FRAME_SIZE_LIMIT_hwaddress", "4096"),
+			sanitizers: []string{"hwaddress"},
+			want:       4096,
+		},
+		{
+			name:       "hwaddress default",
+			env:        envOf(),
+			sanitizers: []string{"hwaddress"},
+			want:       7400,
+		},
+		{
+			name:       "largest limit wins",
+			env:        envOf("ART_DEVICE_FRAME_SIZE_LIMIT_undefined", "9000"),
+			sanitizers: []string{"hwaddress", "undefined"},
+			want:       9000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := artConfigForTest(t, tc.env, prepareForSanitizers(tc.sanitizers, nil))
+			android.AssertIntEquals(t, "DeviceFrameSizeLimit", tc.want, c.DeviceFrameSizeLimit)
+		})
+	}
+}
+
+func TestStackOverflowGaps(t *testing.T) {
+	// Host and device share the gaps, which are the sanitized ones if either
+	// target is sanitized.
+	t.Run("sanitized host", func(t *testing.T) {
+		c := artConfigForTest(t, envOf(), prepareForSanitizers(nil, []string{"address"}))
+		android.AssertDeepEquals(t, "StackOverflowGaps",
+			map[string]int{"arm": 16384, "arm64": 16384, "riscv64": 16384, "x86": 16384, "x86_64": 20480},
+			c.StackOverflowGaps)
+	})
+
+	t.Run("override one arch", func(t *testing.T) {
+		c := artConfigForTest(t, envOf("ART_STACK_OVERFLOW_GAP_arm64", "32768"))
+		android.AssertDeepEquals(t, "StackOverflowGaps",
+			map[string]int{"arm": 8192, "arm64": 32768, "riscv64": 8192, "x86": 8192, "x86_64": 8192},
+			c.StackOverflowGaps)
+		cflags, _ := globalFlags(c)
+		android.AssertStringListContains(t, "cflags", cflags, "-DART_STACK_OVERFLOW_GAP_arm64=32768")
+		android.AssertStringListContains(t, "cflags", cflags, "-DART_STACK_OVERFLOW_GAP_arm=8192")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		runArtErrorTest(t, `ART_STACK_OVERFLOW_GAP_x86 must be a positive integer, got "deep"`,
+			envOf("ART_STACK_OVERFLOW_GAP_x86", "deep"), "")
+	})
+
+	t.Run("unaligned", func(t *testing.T) {
+		runArtErrorTest(t, "ART_STACK_OVERFLOW_GAP_x86 must be a multiple of 4096, got 10000",
+			envOf("ART_STACK_OVERFLOW_GAP_x86", "10000"), "")
+	})
+
+	t.Run("below the frame size limit", func(t *testing.T) {
+		runArtErrorTest(t, "The device frame size limit 5000 must be less than the stack overflow gap 4096 of riscv64",
+			envOf("ART_STACK_OVERFLOW_GAP_riscv64", "4096", "ART_DEVICE_FRAME_SIZE_LIMIT", "5000"), "")
+	})
+}
+
+// ART_ENABLE_ADDRESS_SANITIZER for all combinations of sanitized targets and
+// values of the environment variable.
+func TestAddressSanitizerMatrix(t *testing.T) {
+	for _, device := range []bool{false, true} {
+		for _, host := range []bool{false, true} {
+			for _, value := range []string{"", "true", "false"} {
+				t.Run(fmt.Sprintf("device=%t,host=%t,env=%q", device, host, value), func(t *testing.T) {
+					var deviceSanitizers, hostSanitizers []string
+					if device {
+						deviceSanitizers = []string{"address"}
+					}
+					if host {
+						hostSanitizers = []string{"address"}
+					}
+					env := envOf("ART_ENABLE_ADDRESS_SANITIZER", value)
+					sanitizers := prepareForSanitizers(deviceSanitizers, hostSanitizers)
+					c := artConfigForTest(t, env, sanitizers)
+
+					// An explicit value applies to both targets, otherwise only a
+					// sanitized host gets full sanitization.
+					wantDevice := value == "true"
+					wantHost := value == "true" || (value == "" && host)
+					android.AssertBoolEquals(t, "DeviceAddressSanitizer", wantDevice, c.DeviceAddressSanitizer)
+					android.AssertBoolEquals(t, "HostAddressSanitizer", wantHost, c.HostAddressSanitizer)
+
+					// The define is never repeated, whether it is global or added
+					// by hostFlags.
+					deviceCflags, hostCflags := libfooCflags(t, env, sanitizers)
+					want := func(b bool) int {
+						if b {
+							return 1
+						}
+						return 0
+					}
+					android.AssertIntEquals(t, "device defines", want(wantDevice),
+						countFlag(deviceCflags, "-DART_ENABLE_ADDRESS_SANITIZER=1"))
+					android.AssertIntEquals(t, "host defines", want(wantHost),
+						countFlag(hostCflags, "-DART_ENABLE_ADDRESS_SANITIZER=1"))
+				})
+			}
+		}
+	}
+}
+
+func TestExtraSanitizers(t *testing.T) {
+	t.Run("both", func(t *testing.T) {
+		c := artConfigForTest(t, envOf("ART_EXTRA_SANITIZERS", "undefined, integer_overflow,undefined"),
+			prepareForSanitizers([]string{"address"}, nil))
+		android.AssertDeepEquals(t, "DeviceExtraSanitizers", []string{"undefined", "integer_overflow"}, c.DeviceExtraSanitizers)
+		android.AssertDeepEquals(t, "HostExtraSanitizers", []string{"undefined", "integer_overflow"}, c.HostExtraSanitizers)
+		android.AssertDeepEquals(t, "DeviceSanitizers", []string{"address", "undefined", "integer_overflow"}, c.DeviceSanitizers)
+		android.AssertDeepEquals(t, "HostSanitizers", []string{"undefined", "integer_overflow"}, c.HostSanitizers)
+	})
+
+	t.Run("device", func(t *testing.T) {
+		c := artConfigForTest(t, envOf("ART_EXTRA_SANITIZERS", "undefined", "ART_EXTRA_SANITIZERS_VARIANT", "device"),
+			prepareForSanitizers(nil, nil))
+		android.AssertDeepEquals(t, "DeviceExtraSanitizers", []string{"undefined"}, c.DeviceExtraSanitizers)
+		android.AssertDeepEquals(t, "HostExtraSanitizers", []string(nil), c.HostExtraSanitizers)
+	})
+
+	// The sanitizers are enabled through the sanitize properties of the
+	// defaults.
+	t.Run("compiled", func(t *testing.T) {
+		device, host := libfooCflags(t, envOf("ART_EXTRA_SANITIZERS", "integer_overflow", "ART_EXTRA_SANITIZERS_VARIANT", "device"))
+		android.AssertStringDoesContain(t, "device cflags", device, "signed-integer-overflow")
+		android.AssertStringDoesNotContain(t, "host cflags", host, "signed-integer-overflow")
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		runArtErrorTest(t, `Unknown sanitizer "memory" in ART_EXTRA_SANITIZERS`,
+			envOf("ART_EXTRA_SANITIZERS", "memory"), "", prepareForSanitizers(nil, nil))
+	})
+
+	t.Run("unknown variant", func(t *testing.T) {
+		runArtErrorTest(t, `Unknown ART_EXTRA_SANITIZERS_VARIANT "target"`,
+			envOf("ART_EXTRA_SANITIZERS", "undefined", "ART_EXTRA_SANITIZERS_VARIANT", "target"), "",
+			prepareForSanitizers(nil, nil))
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		runArtErrorTest(t, "sanitizers address and hwaddress cannot be enabled together on device",
+			envOf("ART_EXTRA_SANITIZERS", "address,hwaddress"), "", prepareForSanitizers(nil, nil))
+	})
+
+	t.Run("incompatible with SANITIZE_TARGET", func(t *testing.T) {
+		runArtErrorTest(t, "sanitizers hwaddress and thread cannot be enabled together on device",
+			envOf("ART_EXTRA_SANITIZERS", "thread", "ART_EXTRA_SANITIZERS_VARIANT", "device"), "",
+			prepareForSanitizers([]string{"hwaddress"}, nil))
+	})
+}
+
+// The optional global settings are only defined when set, and validated.
+func TestOptionalGlobalDefines(t *testing.T) {
+	testCases := []struct {
+		name   string
+		envVar string
+		value  string
+		want   []string
+		absent string
+	}{
+		{
+			name:   "default ISA features",
+			envVar: "ART_DEFAULT_ISA_FEATURES",
+			value:  "default,-sve",
+			want:   []string{`-DART_DEFAULT_ISA_FEATURES="default,-sve"`},
+			absent: "-DART_DEFAULT_ISA_FEATURES",
+		},
+		{
+			name:   "native allocator",
+			envVar: "ART_NATIVE_ALLOCATOR",
+			value:  "jemalloc",
+			want:   []string{"-DART_NATIVE_ALLOCATOR_IS_JEMALLOC=1"},
+			absent: "-DART_NATIVE_ALLOCATOR_IS_",
+		},
+		{
+			name:   "large object threshold",
+			envVar: "ART_LARGE_OBJECT_THRESHOLD",
+			value:  "65536",
+			want:   []string{"-DART_LARGE_OBJECT_THRESHOLD=65536"},
+			absent: "-DART_LARGE_OBJECT_THRESHOLD",
+		},
+		{
+			name:   "sanitize coverage",
+			envVar: "ART_SANITIZE_COVERAGE",
+			value:  "trace-pc-guard",
+			want:   []string{"-fsanitize-coverage=trace-pc-guard", `-DART_SANITIZE_COVERAGE_MODE="trace-pc-guard"`},
+			absent: "-DART_SANITIZE_COVERAGE_MODE",
+		},
+		{
+			name:   "verify level",
+			envVar: "ART_DEFAULT_VERIFY_LEVEL",
+			value:  "softfail",
+			want:   []string{"-DART_DEFAULT_VERIFY_LEVEL_IS_SOFTFAIL=1"},
+			absent: "-DART_DEFAULT_VERIFY_LEVEL_IS_",
+		},
+		{
+			name:   "GC thread count",
+			envVar: "ART_GC_THREAD_COUNT",
+			value:  "4",
+			want:   []string{"-DART_GC_THREAD_COUNT=4"},
+			absent: "-DART_GC_THREAD_COUNT",
+		},
+		{
+			name:   "inline threshold",
+			envVar: "ART_INLINE_THRESHOLD",
+			value:  "500",
+			want:   []string{"-mllvm", "-inline-threshold=500"},
+			absent: "-inline-threshold=",
+		},
+	}
+
+	defaultDevice, defaultHost := libfooCflags(t, envOf())
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device, host := libfooCflags(t, envOf(tc.envVar, tc.value))
+			assertSubsequence(t, "device cflags", tc.want, strings.Fields(device))
+			assertSubsequence(t, "host cflags", tc.want, strings.Fields(host))
+
+			android.AssertStringDoesNotContain(t, "device cflags without "+tc.envVar, defaultDevice, tc.absent)
+			android.AssertStringDoesNotContain(t, "host cflags without "+tc.envVar, defaultHost, tc.absent)
+		})
+	}
+
+	errorCases := []struct {
+		envVar, value, err string
+	}{
+		{"ART_DEFAULT_ISA_FEATURES", "sve lse", `Invalid ART_DEFAULT_ISA_FEATURES "sve lse"`},
+		{"ART_NATIVE_ALLOCATOR", "tcmalloc", `Unknown ART_NATIVE_ALLOCATOR "tcmalloc", expected one of jemalloc or scudo`},
+		{"ART_LARGE_OBJECT_THRESHOLD", "-1", `ART_LARGE_OBJECT_THRESHOLD must be a positive integer, got "-1"`},
+		{"ART_SANITIZE_COVERAGE", "edge", `Unknown ART_SANITIZE_COVERAGE "edge"`},
+		{"ART_DEFAULT_VERIFY_LEVEL", "strict", `Unknown ART_DEFAULT_VERIFY_LEVEL "strict", expected one of none, softfail or full`},
+		{"ART_GC_THREAD_COUNT", "0", `ART_GC_THREAD_COUNT must be a positive integer, got "0"`},
+		{"ART_GC_THREAD_COUNT", "many", `ART_GC_THREAD_COUNT must be a positive integer, got "many"`},
+		{"ART_INLINE_THRESHOLD", "high", `ART_INLINE_THRESHOLD must be a non-negative integer, got "high"`},
+	}
+
+	for _, tc := range errorCases {
+		t.Run(fmt.Sprintf("%s=%s", tc.envVar, tc.value), func(t *testing.T) {
+			runArtErrorTest(t, regexp.QuoteMeta(tc.err), envOf(tc.envVar, tc.value), "")
+		})
+	}
+}
+
+func TestD8Desugar(t *testing.T) {
+	testCases := []struct {
+		name       string
+		env        map[string]string
+		use        bool
+		overridden bool
+	}{
+		{name: "unset", env: envOf(), use: true},
+		{name: "USE_D8_DESUGAR=true", env: envOf("USE_D8_DESUGAR", "true"), use: true},
+		{name: "USE_D8_DESUGAR=false", env: envOf("USE_D8_DESUGAR", "false"), use: false},
+		{name: "ART_USE_D8_DESUGAR=false", env: envOf("ART_USE_D8_DESUGAR", "false"), use: false, overridden: true},
+		{
+			name:       "ART_USE_D8_DESUGAR takes precedence",
+			env:        envOf("ART_USE_D8_DESUGAR", "true", "USE_D8_DESUGAR", "false"),
+			use:        true,
+			overridden: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device, _ := libfooCflags(t, tc.env)
+			android.AssertBoolEquals(t, "-DUSE_D8_DESUGAR=1", tc.use, hasFlag(device, "-DUSE_D8_DESUGAR=1"))
+			android.AssertBoolEquals(t, "-DART_D8_DESUGAR_OVERRIDDEN=1", tc.overridden,
+				hasFlag(device, "-DART_D8_DESUGAR_OVERRIDDEN=1"))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		runArtErrorTest(t, `USE_D8_DESUGAR must be unset, true or false, got "maybe"`,
+			envOf("USE_D8_DESUGAR", "maybe"), "")
+	})
+
+	t.Run("log", func(t *testing.T) {
+		buf := captureLog(t)
+		runArtTest(t, envOf("USE_D8_DESUGAR", "false"), libfooBp)
+		android.AssertStringDoesContain(t, "log", buf.String(), "ART: USE_D8_DESUGAR is false")
+	})
+}
+
+func TestD8DesugarPerArch(t *testing.T) {
+	result := runArtTest(t, envOf("ART_USE_D8_DESUGAR_arm", "false"), libfooBp)
+	arm := cflagsOf(result, "libfoo", deviceArmLibVariant)
+	arm64 := cflagsOf(result, "libfoo", deviceLibVariant)
+	android.AssertBoolEquals(t, "arm -UUSE_D8_DESUGAR", true, hasFlag(arm, "-UUSE_D8_DESUGAR"))
+	android.AssertBoolEquals(t, "arm64 -UUSE_D8_DESUGAR", false, hasFlag(arm64, "-UUSE_D8_DESUGAR"))
+	android.AssertBoolEquals(t, "arm64 -DUSE_D8_DESUGAR=1", true, hasFlag(arm64, "-DUSE_D8_DESUGAR=1"))
+
+	runArtErrorTest(t, `ART_USE_D8_DESUGAR_arm must be true or false, got "maybe"`,
+		envOf("ART_USE_D8_DESUGAR_arm", "maybe"), "")
+}
+
+func TestForceAsserts(t *testing.T) {
+	bp := libfooBp + `
+		art_cc_library {
+			name: "libfood",
+			defaults: ["art_debug_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+		}
+	`
+
+	testCases := []struct {
+		value         string
+		ndebug, debug bool
+	}{
+		{value: "", ndebug: false, debug: false},
+		{value: "false", ndebug: false, debug: false},
+		{value: "debug", ndebug: false, debug: true},
+		{value: "true", ndebug: false, debug: true},
+		{value: "all", ndebug: true, debug: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.value), func(t *testing.T) {
+			result := runArtTest(t, envOf("ART_FORCE_ASSERTS", tc.value), bp)
+			for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+				// The DCHECKs are only compiled in when NDEBUG is undefined.
+				foo := cflagsOf(result, "libfoo", variant)
+				android.AssertBoolEquals(t, "libfoo "+variant, tc.ndebug, hasFlag(foo, "-DART_FORCE_DCHECK=1"))
+				android.AssertBoolEquals(t, "libfoo -UNDEBUG "+variant, tc.ndebug, hasFlag(foo, "-UNDEBUG"))
+				food := cflagsOf(result, "libfood", variant)
+				android.AssertBoolEquals(t, "libfood "+variant, tc.debug, hasFlag(food, "-DART_FORCE_DCHECK=1"))
+				android.AssertBoolEquals(t, "libfood -UNDEBUG "+variant, tc.debug, hasFlag(food, "-UNDEBUG"))
+			}
+		})
+	}
+
+	runArtErrorTest(t, `Unknown ART_FORCE_ASSERTS "some"`, envOf("ART_FORCE_ASSERTS", "some"), "")
+}
+
+func TestCxxInterpreter(t *testing.T) {
+	for _, value := range []string{"", "false", "true"} {
+		t.Run(fmt.Sprintf("%q", value), func(t *testing.T) {
+			cflags, _ := globalFlags(artConfigForTest(t, envOf("ART_USE_CXX_INTERPRETER", value)))
+			enabled := "-DART_CXX_INTERPRETER_ENABLED=0"
+			if value == "true" {
+				enabled = "-DART_CXX_INTERPRETER_ENABLED=1"
+			}
+			android.AssertStringListContains(t, "cflags", cflags, enabled)
+			android.AssertBoolEquals(t, "-DART_USE_CXX_INTERPRETER=1", value == "true",
+				android.InList("-DART_USE_CXX_INTERPRETER=1", cflags))
+		})
+	}
+
+	// The opted out module undefines the global defines again.
+	t.Run("opt out", func(t *testing.T) {
+		result := runArtTest(t, envOf("ART_USE_CXX_INTERPRETER", "true"), libfooBp+`
+			art_cc_library {
+				name: "libasm",
+				defaults: ["art_defaults"],
+				srcs: ["foo.cc"],
+				no_cxx_interpreter: true,
+			}
+		`)
+		libfoo := cflagsOf(result, "libfoo", deviceLibVariant)
+		libasm := cflagsOf(result, "libasm", deviceLibVariant)
+		android.AssertBoolEquals(t, "libfoo -UART_USE_CXX_INTERPRETER", false, hasFlag(libfoo, "-UART_USE_CXX_INTERPRETER"))
+		android.AssertStringDoesContain(t, "libasm cflags", libasm,
+			"-UART_USE_CXX_INTERPRETER -UART_CXX_INTERPRETER_ENABLED -DART_CXX_INTERPRETER_ENABLED=0")
+	})
+}
+
+func TestImplicitTargetDefines(t *testing.T) {
+	testCases := []struct {
+		name string
+		env  map[string]string
+		os   string
+	}{
+		{name: "default", env: envOf(), os: "ANDROID"},
+		{name: "android", env: envOf("ART_TARGET_OS", "android"), os: "ANDROID"},
+		{name: "linux", env: envOf("ART_TARGET_OS", "linux"), os: "LINUX"},
+		{name: "fuchsia", env: envOf("ART_TARGET_OS", "fuchsia"), os: "FUCHSIA"},
+		{name: "legacy linux", env: envOf("ART_TARGET_LINUX", "true"), os: "LINUX"},
+		{name: "legacy linux with ART_TARGET_OS", env: envOf("ART_TARGET_LINUX", "true", "ART_TARGET_OS", "linux"), os: "LINUX"},
+	}
+
+	bp := `
+		art_cc_library {
+			name: "libfoo",
+			srcs: ["foo.cc"],
+		}
+
+		art_cc_library {
+			name: "libshared",
+			srcs: ["foo.cc"],
+			no_implicit_art_target_flags: true,
+		}
+	`
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := runArtTest(t, tc.env, bp)
+			libfoo := cflagsOf(result, "libfoo", deviceLibVariant)
+			android.AssertStringDoesContain(t, "libfoo cflags", libfoo, "-DART_TARGET -DART_TARGET_"+tc.os)
+			libshared := cflagsOf(result, "libshared", deviceLibVariant)
+			android.AssertStringDoesContain(t, "libshared cflags", libshared, "-UART_TARGET -UART_TARGET_"+tc.os)
+			android.AssertBoolEquals(t, "libshared -DART_TARGET", false, hasFlag(libshared, "-DART_TARGET"))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		runArtErrorTest(t, `Unknown ART_TARGET_OS "windows"`, envOf("ART_TARGET_OS", "windows"), "")
+	})
+
+	t.Run("conflicting", func(t *testing.T) {
+		runArtErrorTest(t, "Conflicting values for ART_TARGET_OS and ART_TARGET_LINUX",
+			envOf("ART_TARGET_OS", "fuchsia", "ART_TARGET_LINUX", "true"), "")
+	})
+
+	t.Run("legacy warning", func(t *testing.T) {
+		logs := captureLog(t)
+		runArtTest(t, envOf("ART_TARGET_LINUX", "true"), "")
+		android.AssertStringDoesContain(t, "log", logs.String(), "ART_TARGET_LINUX is deprecated, use ART_TARGET_OS=linux instead")
+	})
+}
+
+// The flags that are only enabled on device.
+func TestDeviceOnlyFlags(t *testing.T) {
+	testCases := []struct {
+		envVar, flag string
+	}{
+		{"ART_DEVICE_KEEP_NULL_CHECKS", "-fno-delete-null-pointer-checks"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.envVar, func(t *testing.T) {
+			device, host := libfooCflags(t, envOf(tc.envVar, "true"))
+			android.AssertBoolEquals(t, "device "+tc.flag, true, hasFlag(device, tc.flag))
+			android.AssertBoolEquals(t, "host "+tc.flag, false, hasFlag(host, tc.flag))
+
+			device, _ = libfooCflags(t, envOf())
+			android.AssertBoolEquals(t, "default "+tc.flag, false, hasFlag(device, tc.flag))
+		})
+	}
+}
+
+// ART needs no switch of its own for full RELRO, Soong already links every
+// device module with it.
+func TestFullRelro(t *testing.T) {
+	result := runArtTest(t, envOf(), libfooBp)
+	ldflags := ldflagsOf(result, "libfoo", deviceLibVariant)
+	android.AssertBoolEquals(t, "-Wl,-z,relro", true, hasFlag(ldflags, "-Wl,-z,relro"))
+	android.AssertBoolEquals(t, "-Wl,-z,now", true, hasFlag(ldflags, "-Wl,-z,now"))
+}
+
+func TestBootImageLocation(t *testing.T) {
+	device, host := libfooCflags(t, envOf())
+	android.AssertBoolEquals(t, "default device define", true,
+		hasFlag(device, `-DART_DEFAULT_BOOT_IMAGE_LOCATION="/apex/com.android.art/javalib/boot.art"`))
+	android.AssertBoolEquals(t, "default host define", true,
+		hasFlag(host, `-DART_DEFAULT_BOOT_IMAGE_LOCATION="apex/art_boot_images/javalib/boot.art"`))
+
+	device, host = libfooCflags(t, envOf(
+		"ART_TARGET_DEFAULT_BOOT_IMAGE_LOCATION", "/system/framework/boot.art",
+		"ART_HOST_DEFAULT_BOOT_IMAGE_LOCATION", "framework/boot.art"))
+	android.AssertBoolEquals(t, "device define", true,
+		hasFlag(device, `-DART_DEFAULT_BOOT_IMAGE_LOCATION="/system/framework/boot.art"`))
+	android.AssertBoolEquals(t, "host define", true,
+		hasFlag(host, `-DART_DEFAULT_BOOT_IMAGE_LOCATION="framework/boot.art"`))
+
+	runArtErrorTest(t, "ART_TARGET_DEFAULT_BOOT_IMAGE_LOCATION must not be empty",
+		envOf("ART_TARGET_DEFAULT_BOOT_IMAGE_LOCATION", " "), "")
+}
+
+func TestHostExtraDefines(t *testing.T) {
+	device, host := libfooCflags(t, envOf("ART_HOST_EXTRA_DEFINES", "-DFOO=1  -DBAR"))
+	android.AssertStringDoesContain(t, "host cflags", host, "-DFOO=1 -DBAR")
+	android.AssertBoolEquals(t, "device -DFOO=1", false, hasFlag(device, "-DFOO=1"))
+	android.AssertBoolEquals(t, "device -DBAR", false, hasFlag(device, "-DBAR"))
+
+	runArtErrorTest(t, `ART_HOST_EXTRA_DEFINES must only contain -D flags, got "-fno-foo"`,
+		envOf("ART_HOST_EXTRA_DEFINES", "-DFOO -fno-foo"), "")
+}
+
+func TestParseBaseAddressDelta(t *testing.T) {
+	testCases := []struct {
+		delta string
+		want  int64
+		err   bool
+	}{
+		{delta: "(-0x1000000)", want: -0x1000000},
+		{delta: "0x1000000", want: 0x1000000},
+		{delta: " ( -0x2000 ) ", want: -0x2000},
+		{delta: "4096", want: 4096},
+		{delta: "garbage", err: true},
+		{delta: "", err: true},
+		{delta: "(0x1000", err: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseBaseAddressDelta(tc.delta)
+		android.AssertBoolEquals(t, fmt.Sprintf("error for %q", tc.delta), tc.err, err != nil)
+		if !tc.err {
+			android.AssertDeepEquals(t, fmt.Sprintf("value of %q", tc.delta), tc.want, got)
+		}
+	}
+}
+
+func TestBaseAddressDeltaSignFlag(t *testing.T) {
+	testCases := []struct {
+		delta, want string
+	}{
+		{"(-0x1000000)", "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=1"},
+		{"( -0x1000000)", "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=1"},
+		{"-0x1000", "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=1"},
+		{"0x1000000", "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=0"},
+		{"(0x1000)", "-DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=0"},
+	}
+
+	for _, tc := range testCases {
+		android.AssertStringEquals(t, tc.delta, tc.want, baseAddressDeltaSignFlag(tc.delta))
+	}
+}
+
+func TestBaseAddressDeltas(t *testing.T) {
+	device, host := libfooCflags(t, envOf(
+		"LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA", "(-0x2000000)",
+		"LIBART_IMG_TARGET_MAX_BASE_ADDRESS_DELTA", "0x2000000",
+		"LIBART_IMG_HOST_MIN_BASE_ADDRESS_DELTA", "0x1000",
+		"LIBART_IMG_HOST_MAX_BASE_ADDRESS_DELTA", "0x3000"))
+	android.AssertStringDoesContain(t, "device cflags", device,
+		"-DART_BASE_ADDRESS_MIN_DELTA=(-0x2000000) -DART_BASE_ADDRESS_MAX_DELTA=0x2000000 -DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=1")
+	android.AssertStringDoesContain(t, "host cflags", host,
+		"-DART_BASE_ADDRESS_MIN_DELTA=0x1000 -DART_BASE_ADDRESS_MAX_DELTA=0x3000 -DART_BASE_ADDRESS_MIN_DELTA_IS_NEGATIVE=0")
+
+	runArtErrorTest(t, regexp.QuoteMeta("LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA 0x2000000 must be less than LIBART_IMG_TARGET_MAX_BASE_ADDRESS_DELTA 0x1000000"),
+		envOf("LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA", "0x2000000"), "")
+	runArtErrorTest(t, `Invalid LIBART_IMG_HOST_MAX_BASE_ADDRESS_DELTA "lots"`,
+		envOf("LIBART_IMG_HOST_MAX_BASE_ADDRESS_DELTA", "lots"), "")
+}
+
+func TestWerrorList(t *testing.T) {
+	device, host := libfooCflags(t, envOf("ART_WERROR_LIST", "unused-variable, shadow"))
+	for _, cflags := range []string{device, host} {
+		android.AssertBoolEquals(t, "-Werror=unused-variable", true, hasFlag(cflags, "-Werror=unused-variable"))
+		android.AssertBoolEquals(t, "-Werror=shadow", true, hasFlag(cflags, "-Werror=shadow"))
+		android.AssertBoolEquals(t, "-Werror=unused-parameter", false, hasFlag(cflags, "-Werror=unused-parameter"))
+	}
+
+	runArtErrorTest(t, `Invalid warning name "Unused Variable" in ART_WERROR_LIST`,
+		envOf("ART_WERROR_LIST", "Unused Variable"), "")
+}
+
+func TestRequiredEnv(t *testing.T) {
+	runArtErrorTest(t, "LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA must be set, it is listed in ART_REQUIRED_ENV",
+		envOf("ART_REQUIRED_ENV", "ART_HEAP_POISONING, LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA",
+			"ART_HEAP_POISONING", "true"), "")
+
+	runArtTest(t, envOf("ART_REQUIRED_ENV", "ART_HEAP_POISONING, LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA",
+		"ART_HEAP_POISONING", "true",
+		"LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA", "(-0x1000000)"), "")
+}
+
+func TestEmitStackUsage(t *testing.T) {
+	result := runArtTest(t, envOf("ART_EMIT_STACK_USAGE", "libbaz,libbar"), libfooBp+`
+		art_cc_library {
+			name: "libbar",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["bar.cc"],
+		}
+	`)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		android.AssertBoolEquals(t, "libbar "+variant, true, hasFlag(cflagsOf(result, "libbar", variant), "-fstack-usage"))
+		android.AssertBoolEquals(t, "libfoo "+variant, false, hasFlag(cflagsOf(result, "libfoo", variant), "-fstack-usage"))
+	}
+}
+
+// The modules in ART_O0_MODULES are built with -O0, also over the per-target
+// optimization flags.
+func TestO0Modules(t *testing.T) {
+	result := runArtTest(t, envOf("ART_O0_MODULES", "libbar, libbaz", "ART_NDEBUG_OPT_FLAG_DEVICE", "-O2"), libfooBp+`
+		art_cc_library {
+			name: "libbar",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["bar.cc"],
+		}
+	`)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		android.AssertStringEquals(t, "libbar "+variant, "-O0", lastOptFlag(cflagsOf(result, "libbar", variant)))
+		android.AssertBoolEquals(t, "libfoo "+variant, false, hasFlag(cflagsOf(result, "libfoo", variant), "-O0"))
+	}
+}
+
+// The extra flags come after the computed target flags, in order.
+func TestExtraFlags(t *testing.T) {
+	result := runArtTest(t, envOf("ART_EXTRA_CFLAGS", "-DFOO=1 -DBAR=2"), libfooBp)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		cflags := cflagsOf(result, "libfoo", variant)
+		android.AssertStringDoesContain(t, variant+" cflags", cflags, "-DFOO=1 -DBAR=2")
+		fields := strings.Fields(cflags)
+		assertSubsequence(t, variant+" cflags", []string{"-Wframe-larger-than=1736", "-DFOO=1", "-DBAR=2"}, fields)
+	}
+}
+
+func TestPgo(t *testing.T) {
+	t.Run("instrument", func(t *testing.T) {
+		result := runArtTest(t, envOf("ART_PGO_INSTRUMENT", "/data/local/tmp/pgo"), libfooBp)
+		device := cflagsOf(result, "libfoo", deviceLibVariant)
+		android.AssertBoolEquals(t, "device cflags", true, hasFlag(device, "-fprofile-generate=/data/local/tmp/pgo"))
+		android.AssertStringDoesContain(t, "device ldflags", ldflagsOf(result, "libfoo", deviceLibVariant),
+			"-fprofile-generate=/data/local/tmp/pgo")
+		host := cflagsOf(result, "libfoo", hostLibVariant)
+		android.AssertBoolEquals(t, "host cflags", false, hasFlag(host, "-fprofile-generate=/data/local/tmp/pgo"))
+	})
+
+	t.Run("instrument with profile dir", func(t *testing.T) {
+		runArtErrorTest(t, "ART_PGO_INSTRUMENT and ART_PGO_PROFILE_DIR cannot be set together",
+			envOf("ART_PGO_INSTRUMENT", "/data/local/tmp/pgo", "ART_PGO_PROFILE_DIR", "art/pgo"), libfooBp)
+	})
+
+	t.Run("instrument with profile", func(t *testing.T) {
+		runArtErrorTest(t, "ART_PGO_INSTRUMENT and ART_PGO_PROFILE cannot be set together",
+			envOf("ART_PGO_INSTRUMENT", "/data/local/tmp/pgo", "ART_PGO_PROFILE", "art/art.profdata"), libfooBp,
+			android.FixtureAddFile("art/art.profdata", nil))
+	})
+
+	t.Run("profile", func(t *testing.T) {
+		device, host := libfooCflags(t, envOf("ART_PGO_PROFILE", "art/art.profdata"),
+			android.FixtureAddFile("art/art.profdata", nil))
+		for _, cflags := range []string{device, host} {
+			android.AssertStringDoesContain(t, "cflags", cflags, "-fprofile-use=art/art.profdata -Wno-profile-instr-unprofiled")
+		}
+	})
+
+	t.Run("no profile", func(t *testing.T) {
+		device, host := libfooCflags(t, envOf())
+		for _, cflags := range []string{device, host} {
+			android.AssertStringDoesNotContain(t, "cflags", cflags, "-fprofile-use=")
+			android.AssertStringDoesNotContain(t, "cflags", cflags, "-fprofile-generate=")
+		}
+	})
+
+	t.Run("missing profile", func(t *testing.T) {
+		runArtErrorTest(t, `ART_PGO_PROFILE "art/missing.profdata" does not exist`,
+			envOf("ART_PGO_PROFILE", "art/missing.profdata"), "")
+	})
+}
+
+func TestLto(t *testing.T) {
+	t.Run("thin", func(t *testing.T) {
+		// Soong adds the flags for the lto property.
+		device, _ := libfooCflags(t, envOf("ART_ENABLE_LTO", "true"))
+		android.AssertBoolEquals(t, "-flto=thin", true, hasFlag(device, "-flto=thin"))
+
+		device, _ = libfooCflags(t, envOf())
+		android.AssertBoolEquals(t, "-flto=thin without LTO", false, hasFlag(device, "-flto=thin"))
+	})
+
+	t.Run("full", func(t *testing.T) {
+		result := runArtTest(t, envOf("ART_ENABLE_LTO", "true", "ART_LTO_FULL", "true"), libfooBp)
+		device := cflagsOf(result, "libfoo", deviceLibVariant)
+		android.AssertBoolEquals(t, "-flto", true, hasFlag(device, "-flto"))
+		android.AssertBoolEquals(t, "-flto=thin", false, hasFlag(device, "-flto=thin"))
+		android.AssertBoolEquals(t, "ldflags -flto", true, hasFlag(ldflagsOf(result, "libfoo", deviceLibVariant), "-flto"))
+
+		// ART_LTO_FULL has no effect without ART_ENABLE_LTO.
+		device, _ = libfooCflags(t, envOf("ART_LTO_FULL", "true"))
+		android.AssertBoolEquals(t, "-flto without ART_ENABLE_LTO", false, hasFlag(device, "-flto"))
+	})
+
+	t.Run("sanitizer warning", func(t *testing.T) {
+		warning := "ART_ENABLE_LTO is not supported with address sanitizers"
+
+		logs := captureLog(t)
+		runArtTest(t, envOf("ART_ENABLE_LTO", "true"), "", prepareForSanitizers([]string{"hwaddress"}, nil))
+		android.AssertStringDoesContain(t, "log", logs.String(), warning)
+
+		logs = captureLog(t)
+		runArtTest(t, envOf("ART_ENABLE_LTO", "true", "ART_EXTRA_SANITIZERS", "address"), "")
+		android.AssertStringDoesContain(t, "log with ART_EXTRA_SANITIZERS", logs.String(), warning)
+
+		logs = captureLog(t)
+		runArtTest(t, envOf("ART_ENABLE_LTO", "true"), "", prepareForSanitizers(nil, []string{"undefined"}))
+		android.AssertStringDoesNotContain(t, "log", logs.String(), warning)
+	})
+}
+
+func TestDeviceLinkerScript(t *testing.T) {
+	result := runArtTest(t, envOf("ART_DEVICE_LINKER_SCRIPT", "art/extra.ld"), libfooBp,
+		android.FixtureAddFile("art/extra.ld", nil))
+	android.AssertStringDoesContain(t, "device ldflags", ldflagsOf(result, "libfoo", deviceLibVariant), "-Wl,-Tart/extra.ld")
+	android.AssertStringDoesNotContain(t, "host ldflags", ldflagsOf(result, "libfoo", hostLibVariant), "-Wl,-Tart/extra.ld")
+
+	runArtErrorTest(t, `ART_DEVICE_LINKER_SCRIPT "art/missing.ld" does not exist`,
+		envOf("ART_DEVICE_LINKER_SCRIPT", "art/missing.ld"), libfooBp)
+}
+
+func TestStripComment(t *testing.T) {
+	flag := "-Wl,-T" + stripCommentScript
+	result := runArtTest(t, envOf("ART_STRIP_COMMENT", "true"), libfooBp)
+	android.AssertStringDoesContain(t, "device ldflags", ldflagsOf(result, "libfoo", deviceLibVariant), flag)
+	android.AssertStringDoesNotContain(t, "host ldflags", ldflagsOf(result, "libfoo", hostLibVariant), flag)
+	android.AssertStringDoesNotContain(t, "cflags", cflagsOf(result, "libfoo", deviceLibVariant), "-fno-ident")
+
+	result = runArtTest(t, envOf(), libfooBp)
+	android.AssertStringDoesNotContain(t, "default ldflags", ldflagsOf(result, "libfoo", deviceLibVariant), flag)
+}
+
+func TestIsaFeatures(t *testing.T) {
+	result := runArtTest(t, envOf("ART_ARM64_FEATURES", "sve, lse,sve"), libfooBp)
+	arm64 := cflagsOf(result, "libfoo", deviceLibVariant)
+	android.AssertStringDoesContain(t, "arm64 cflags", arm64, "-DART_ISA_FEATURE_SVE=1 -DART_ISA_FEATURE_LSE=1")
+	for _, variant := range []string{deviceArmLibVariant, hostLibVariant, hostX86LibVariant} {
+		android.AssertStringDoesNotContain(t, variant+" cflags", cflagsOf(result, "libfoo", variant), "-DART_ISA_FEATURE_")
+	}
+
+	android.AssertDeepEquals(t, "x86 defines", []string{"-DART_ISA_FEATURE_SSE4_1=1", "-DART_ISA_FEATURE_AVX2=1"},
+		isaFeatureFlags([]string{"sse4.1", "avx2"}))
+
+	runArtErrorTest(t, `Unknown feature "avx" in ART_ARM64_FEATURES`, envOf("ART_ARM64_FEATURES", "avx"), "")
+	runArtErrorTest(t, `Unknown feature "neon" in ART_ARM_FEATURES`, envOf("ART_ARM_FEATURES", "neon"), "")
+}
+
+func TestPointerSize(t *testing.T) {
+	result := runArtTest(t, envOf(), libfooBp)
+	testCases := []struct {
+		variant string
+		size    int
+	}{
+		{deviceLibVariant, 8},
+		{deviceArmLibVariant, 4},
+		{hostLibVariant, 8},
+		{hostX86LibVariant, 4},
+	}
+	for _, tc := range testCases {
+		android.AssertBoolEquals(t, tc.variant, true,
+			hasFlag(cflagsOf(result, "libfoo", tc.variant), fmt.Sprintf("-DART_TARGET_POINTER_SIZE=%d", tc.size)))
+	}
+
+	for _, arch := range SupportedArches() {
+		want := "-DART_TARGET_POINTER_SIZE=4"
+		if arch == "arm64" || arch == "riscv64" || arch == "x86_64" {
+			want = "-DART_TARGET_POINTER_SIZE=8"
+		}
+		android.AssertStringEquals(t, arch, want, pointerSizeArchFlag(arch))
+	}
+}
+
+func TestBranchProtection(t *testing.T) {
+	result := runArtTest(t, envOf("ART_DEVICE_BRANCH_PROTECTION", "pac-ret"), libfooBp)
+	android.AssertBoolEquals(t, "arm64", true,
+		hasFlag(cflagsOf(result, "libfoo", deviceLibVariant), "-mbranch-protection=pac-ret"))
+	for _, variant := range []string{deviceArmLibVariant, hostLibVariant} {
+		android.AssertStringDoesNotContain(t, variant, cflagsOf(result, "libfoo", variant), "-mbranch-protection")
+	}
+
+	runArtErrorTest(t, `Unknown ART_DEVICE_BRANCH_PROTECTION "pac"`,
+		envOf("ART_DEVICE_BRANCH_PROTECTION", "pac"), "")
+	runArtErrorTest(t, "ART_DEVICE_BRANCH_PROTECTION is only supported on arm64 devices",
+		envOf("ART_DEVICE_BRANCH_PROTECTION", "bti"), "", prepareForX86_64Device)
+}
+
+func TestCfProtection(t *testing.T) {
+	result := runArtTest(t, envOf("ART_DEVICE_CF_PROTECTION", "return"), libfooBp, prepareForX86_64Device)
+	android.AssertBoolEquals(t, "x86_64", true,
+		hasFlag(cflagsOf(result, "libfoo", "android_x86_64_shared"), "-fcf-protection=return"))
+	android.AssertStringDoesNotContain(t, "host", cflagsOf(result, "libfoo", hostLibVariant), "-fcf-protection")
+
+	runArtErrorTest(t, `Unknown ART_DEVICE_CF_PROTECTION "all"`, envOf("ART_DEVICE_CF_PROTECTION", "all"), "",
+		prepareForX86_64Device)
+	runArtErrorTest(t, "ART_DEVICE_CF_PROTECTION is only supported on x86_64 devices",
+		envOf("ART_DEVICE_CF_PROTECTION", "full"), "")
+}
+
+func TestImplicitNullChecks(t *testing.T) {
+	result := runArtTest(t, envOf("ART_IMPLICIT_NULL_CHECKS_arm", "false"), libfooBp)
+	android.AssertBoolEquals(t, "arm", true,
+		hasFlag(cflagsOf(result, "libfoo", deviceArmLibVariant), "-DART_IMPLICIT_NULL_CHECKS=0"))
+	android.AssertBoolEquals(t, "arm64", true,
+		hasFlag(cflagsOf(result, "libfoo", deviceLibVariant), "-DART_IMPLICIT_NULL_CHECKS=1"))
+	android.AssertStringDoesNotContain(t, "host", cflagsOf(result, "libfoo", hostLibVariant), "-DART_IMPLICIT_NULL_CHECKS")
+
+	runArtErrorTest(t, `ART_IMPLICIT_NULL_CHECKS_arm64 must be true or false, got "later"`,
+		envOf("ART_IMPLICIT_NULL_CHECKS_arm64", "later"), "")
+}
+
+func TestSimulator(t *testing.T) {
+	device, host := libfooCflags(t, envOf("ART_USE_SIMULATOR", "true"))
+	android.AssertStringDoesContain(t, "host cflags", host,
+		`-DART_SIMULATOR_ENABLED=1 -DART_SIMULATOR_TARGET_ISA_IS_arm64=1 -DART_SIMULATOR_TARGET_ISA_NAME="arm64"`)
+	android.AssertStringDoesNotContain(t, "device cflags", device, "-DART_SIMULATOR_")
+
+	_, host = libfooCflags(t, envOf())
+	android.AssertStringDoesNotContain(t, "host cflags without simulator", host, "-DART_SIMULATOR_")
+
+	runArtErrorTest(t, `Unknown ART_SIMULATOR_TARGET_ISA "riscv64"`,
+		envOf("ART_USE_SIMULATOR", "true", "ART_SIMULATOR_TARGET_ISA", "riscv64"), "")
+}
+
+func TestHeapPoisoningWarning(t *testing.T) {
+	warning := "ART_HEAP_POISONING is not supported with the generational CMC GC"
+	testCases := []struct {
+		name        string
+		env         map[string]string
+		readBarrier bool
+		warns       bool
+	}{
+		{
+			name:  "generational CMC",
+			env:   envOf("ART_HEAP_POISONING", "true", "ART_USE_GENERATIONAL_GC", "true"),
+			warns: true,
+		},
+		{
+			name:  "GENCMC",
+			env:   envOf("ART_HEAP_POISONING", "true", "ART_DEFAULT_GC_TYPE", "GENCMC"),
+			warns: true,
+		},
+		{
+			name: "CMC",
+			env:  envOf("ART_HEAP_POISONING", "true"),
+		},
+		{
+			name:        "generational CC",
+			env:         envOf("ART_HEAP_POISONING", "true", "ART_USE_GENERATIONAL_GC", "true"),
+			readBarrier: true,
+		},
+		{
+			name: "no heap poisoning",
+			env:  envOf("ART_USE_GENERATIONAL_GC", "true"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLog(t)
+			artConfigForTest(t, tc.env, prepareForReadBarrier(tc.readBarrier))
+			android.AssertBoolEquals(t, "warning", tc.warns, strings.Contains(logs.String(), warning))
+		})
+	}
+}
+
+func TestCustomLinker(t *testing.T) {
+	bp := `
+		art_cc_binary {
+			name: "foo",
+			defaults: ["art_defaults"],
+			srcs: ["foo.cc"],
+		}
+	`
+	warning := "is not a known linker path"
+
+	t.Run("known", func(t *testing.T) {
+		logs := captureLog(t)
+		result := runArtTest(t, envOf("CUSTOM_TARGET_LINKER", "/apex/com.android.runtime/bin/linker64"), bp)
+		android.AssertStringDoesContain(t, "ldflags", ldflagsOf(result, "foo", deviceVariant),
+			"-Wl,-dynamic-linker,/apex/com.android.runtime/bin/linker64")
+		android.AssertStringDoesNotContain(t, "log", logs.String(), warning)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		logs := captureLog(t)
+		result := runArtTest(t, envOf("CUSTOM_TARGET_LINKER", "/vendor/bin/linker64"), bp)
+		android.AssertStringDoesContain(t, "ldflags", ldflagsOf(result, "foo", deviceVariant),
+			"-Wl,-dynamic-linker,/vendor/bin/linker64")
+		android.AssertStringDoesContain(t, "log", logs.String(), warning)
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		result := runArtTest(t, envOf(), bp)
+		android.AssertStringDoesNotContain(t, "ldflags", ldflagsOf(result, "foo", deviceVariant), "/vendor/bin/linker64")
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		runArtErrorTest(t, `CUSTOM_TARGET_LINKER "/vendor/bin/linker64" is not a known linker path`,
+			envOf("CUSTOM_TARGET_LINKER", "/vendor/bin/linker64", "ART_STRICT_CUSTOM_LINKER", "true"), bp)
+	})
+
+	t.Run("relative", func(t *testing.T) {
+		runArtErrorTest(t, `CUSTOM_TARGET_LINKER "bin/linker64" must be an absolute path`,
+			envOf("CUSTOM_TARGET_LINKER", "bin/linker64"), bp)
+	})
+
+	t.Run("blank", func(t *testing.T) {
+		runArtErrorTest(t, "CUSTOM_TARGET_LINKER must not be blank", envOf("CUSTOM_TARGET_LINKER", "  "), bp)
+	})
+}
+
+func TestTestcasesContent(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_library {
+			name: "liba",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+		}
+
+		art_cc_library {
+			name: "libb",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["bar.cc"],
+		}
+
+		art_cc_binary {
+			name: "plain",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+		}
+
+		art_cc_binary {
+			name: "nested",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+			relative_install_path: "arm64",
+		}
+	`)
+
+	content := ArtTestcasesContent(result.Config)
+	for dst, src := range map[string]string{
+		"lib64/liba.so":    "liba.so",
+		"lib64/libb.so":    "libb.so",
+		"bin/plain":        "plain",
+		"bin/arm64/nested": "nested",
+	} {
+		if !strings.HasSuffix(content[dst], "/"+src) {
+			t.Errorf("expected %s to be copied from a %s, got %q", dst, src, content[dst])
+		}
+	}
+
+	// Only host files are staged.
+	for dst := range content {
+		if strings.Contains(dst, "nativetest") || strings.HasPrefix(dst, "host-cross/") {
+			t.Errorf("unexpected testcases entry %s", dst)
+		}
+	}
+
+	// The returned map is a copy.
+	content["lib64/liba.so"] = ""
+	android.AssertBoolEquals(t, "entry after modifying the copy", true,
+		ArtTestcasesContent(result.Config)["lib64/liba.so"] != "")
+}
+
+func TestTestcasesConflict(t *testing.T) {
+	runArtErrorTest(t, `Conflicting sources for bin/dup: .* from module dup_[ab] and .* from module dup_[ab]`, envOf(), `
+		art_cc_binary {
+			name: "dup_a",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			device_supported: false,
+			srcs: ["foo.cc"],
+			stem: "dup",
+		}
+
+		art_cc_binary {
+			name: "dup_b",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			device_supported: false,
+			srcs: ["bar.cc"],
+			stem: "dup",
+		}
+	`)
+}
+
+// Host cross modules are only staged when they opt in, under host-cross/.
+func TestTestcasesHostCross(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_binary {
+			name: "cross_tool",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			device_supported: false,
+			srcs: ["foo.cc"],
+			force_testcases_staging: true,
+			target: {
+				windows: {
+					enabled: true,
+				},
+			},
+		}
+
+		art_cc_binary {
+			name: "host_tool",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			device_supported: false,
+			srcs: ["foo.cc"],
+			target: {
+				windows: {
+					enabled: true,
+				},
+			},
+		}
+	`, prepareForHostCross)
+
+	content := testcasesContent(result.Config)
+	var crossEntries []string
+	for dst := range content {
+		if strings.HasPrefix(dst, "host-cross/") {
+			crossEntries = append(crossEntries, dst)
+		}
+	}
+	android.AssertIntEquals(t, "host cross entries", 1, len(crossEntries))
+	assertMatches(t, "host cross entry", crossEntries[0], `^host-cross/bin/cross_tool(\.exe)?$`)
+	android.AssertBoolEquals(t, "host tool", true, content["bin/host_tool"].Src != "")
+	android.AssertBoolEquals(t, "cross tool", true, content["bin/cross_tool"].Src != "")
+}
+
+func TestTestcasesDataMap(t *testing.T) {
+	bp := `
+		art_cc_test {
+			name: "art_data_tests",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			gtest: false,
+			srcs: ["foo.cc"],
+			testcases_data_map: [
+				"data/a.txt:a.txt",
+				"data/b.txt:sub/b.txt",
+			],
+		}
+	`
+	result := runArtTest(t, envOf(), bp)
+	content := ArtTestcasesContent(result.Config)
+	android.AssertStringEquals(t, "a.txt", "art/data/a.txt", content["art_data_tests/a.txt"])
+	android.AssertStringEquals(t, "b.txt", "art/data/b.txt", content["art_data_tests/sub/b.txt"])
+
+	runArtErrorTest(t, `testcases_data_map: destination "../a.txt" must be a relative path below the test`, envOf(), `
+		art_cc_test {
+			name: "art_data_tests",
+			host_supported: true,
+			gtest: false,
+			srcs: ["foo.cc"],
+			testcases_data_map: ["data/a.txt:../a.txt"],
+		}
+	`)
+	runArtErrorTest(t, `testcases_data_map: expected <src>:<dst>, got "data/a.txt"`, envOf(), `
+		art_cc_test {
+			name: "art_data_tests",
+			host_supported: true,
+			gtest: false,
+			srcs: ["foo.cc"],
+			testcases_data_map: ["data/a.txt"],
+		}
+	`)
+	runArtErrorTest(t, "Conflicting sources for art_data_tests/a.txt", envOf(), `
+		art_cc_test {
+			name: "art_data_tests",
+			host_supported: true,
+			gtest: false,
+			srcs: ["foo.cc"],
+			testcases_data_map: [
+				"data/a.txt:a.txt",
+				"data/b.txt:a.txt",
+			],
+		}
+	`)
+
+	// The 32 and 64 bit variants stage the same files.
+	result = runArtTest(t, envOf(), `
+		art_cc_test {
+			name: "art_data_tests",
+			host_supported: true,
+			gtest: false,
+			compile_multilib: "both",
+			srcs: ["foo.cc"],
+			testcases_data_map: ["data/a.txt:a.txt"],
+		}
+	`)
+	android.AssertStringEquals(t, "multilib a.txt", "art/data/a.txt", ArtTestcasesContent(result.Config)["art_data_tests/a.txt"])
+}
+
+func TestTestcasesData(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_testcases_data {
+			name: "foo_data",
+			src: "data/a.txt",
+			testcases_dst: "art/data/foo.txt",
+		}
+	`)
+	assertMatches(t, "art/data/foo.txt", ArtTestcasesContent(result.Config)["art/data/foo.txt"], `a\.txt$`)
+
+	runArtErrorTest(t, "Conflicting sources for art/data/foo.txt", envOf(), `
+		art_testcases_data {
+			name: "foo_data",
+			src: "data/a.txt",
+			testcases_dst: "art/data/foo.txt",
+		}
+
+		art_testcases_data {
+			name: "bar_data",
+			src: "data/b.txt",
+			testcases_dst: "art/data/foo.txt",
+		}
+	`)
+	// Different modules conflict even if they copy the same file.
+	runArtErrorTest(t, "Conflicting sources for art/data/foo.txt", envOf(), `
+		art_testcases_data {
+			name: "foo_data",
+			src: "data/a.txt",
+			testcases_dst: "art/data/foo.txt",
+		}
+
+		art_testcases_data {
+			name: "bar_data",
+			src: "data/a.txt",
+			testcases_dst: "art/data/foo.txt",
+		}
+	`)
+	runArtErrorTest(t, `testcases_dst: must be a relative path, got "/data/foo.txt"`, envOf(), `
+		art_testcases_data {
+			name: "foo_data",
+			src: "data/a.txt",
+			testcases_dst: "/data/foo.txt",
+		}
+	`)
+}
+
+func TestIsRelativeTestcasesPath(t *testing.T) {
+	testCases := []struct {
+		path string
+		want bool
+	}{
+		{"a.txt", true},
+		{"sub/b.txt", true},
+		{"..a.txt", true},
+		{"/a.txt", false},
+		{"..", false},
+		{"../a.txt", false},
+		{"sub/../../a.txt", false},
+		{"./a.txt", false},
+		{"sub//a.txt", false},
+	}
+
+	for _, tc := range testCases {
+		android.AssertBoolEquals(t, tc.path, tc.want, isRelativeTestcasesPath(tc.path))
+	}
+}
+
+func TestHostOnly(t *testing.T) {
+	bp := libfooBp + `
+		art_cc_library {
+			name: "libdevice",
+			defaults: ["art_defaults"],
+			host_supported: false,
+			srcs: ["foo.cc"],
+		}
+
+		cc_defaults {
+			name: "host_defaults",
+			host_supported: true,
+		}
+
+		art_cc_library {
+			name: "libhostdefaults",
+			defaults: ["art_defaults", "host_defaults"],
+			srcs: ["foo.cc"],
+		}
+	`
+
+	logs := captureLog(t)
+	result := runArtTest(t, envOf("ART_HOST_ONLY", "true"), bp)
+	android.AssertBoolEquals(t, "libfoo device", false, hasRule(result, "libfoo", deviceLibVariant, "cc"))
+	android.AssertBoolEquals(t, "libfoo host", true, hasRule(result, "libfoo", hostLibVariant, "cc"))
+	android.AssertBoolEquals(t, "libdevice device", false, hasRule(result, "libdevice", deviceLibVariant, "cc"))
+	android.AssertStringDoesContain(t, "log", logs.String(),
+		"libdevice does not support host and is not built for ART_HOST_ONLY=true")
+	android.AssertStringDoesNotContain(t, "log", logs.String(), "libfoo does not support host")
+
+	// host_supported from defaults is not applied when the hook runs, but the
+	// module is still built for the host.
+	android.AssertBoolEquals(t, "libhostdefaults host", true, hasRule(result, "libhostdefaults", hostLibVariant, "cc"))
+	android.AssertStringDoesNotContain(t, "log", logs.String(), "libhostdefaults does not support host")
+
+	result = runArtTest(t, envOf(), bp)
+	android.AssertBoolEquals(t, "libfoo device without ART_HOST_ONLY", true, hasRule(result, "libfoo", deviceLibVariant, "cc"))
+}
+
+func TestHostLibrary(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_library_host {
+			name: "libhost",
+			srcs: ["foo.cc"],
+		}
+	`)
+	android.AssertDeepEquals(t, "device variants", []string(nil), variantsWithPrefix(result, "libhost", "android_"))
+	cflags := cflagsOf(result, "libhost", hostLibVariant)
+	android.AssertBoolEquals(t, "host variant", true, cflags != "")
+	android.AssertBoolEquals(t, "static variant", true, hasRule(result, "libhost", hostVariant+"_static", "cc"))
+}
+
+func TestTestLibraryLinkage(t *testing.T) {
+	testCases := []struct {
+		linkage        string
+		static, shared bool
+	}{
+		{linkage: "both", static: true, shared: true},
+		{linkage: "shared", static: false, shared: true},
+		{linkage: "static", static: true, shared: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.linkage, func(t *testing.T) {
+			result := runArtTest(t, envOf(), fmt.Sprintf(`
+				art_cc_test_library {
+					name: "libtest",
+					defaults: ["art_defaults"],
+					srcs: ["foo.cc"],
+					test_library_linkage: %q,
+				}
+			`, tc.linkage))
+			android.AssertBoolEquals(t, "static", tc.static, hasRule(result, "libtest", deviceVariant+"_static", "ar"))
+			android.AssertBoolEquals(t, "shared", tc.shared, hasRule(result, "libtest", deviceLibVariant, "ld"))
+		})
+	}
+
+	runArtErrorTest(t, `test_library_linkage: unknown value "dynamic"`, envOf(), `
+		art_cc_test_library {
+			name: "libtest",
+			srcs: ["foo.cc"],
+			test_library_linkage: "dynamic",
+		}
+	`)
+}
+
+func TestCompileMultilib(t *testing.T) {
+	testCases := []struct {
+		name         string
+		env          map[string]string
+		multilib     string
+		device, host []string
+	}{
+		{
+			name:   "default",
+			env:    envOf(),
+			device: []string{deviceVariant},
+			host:   []string{hostVariant},
+		},
+		{
+			name:     "64",
+			env:      envOf(),
+			multilib: "64",
+			device:   []string{deviceVariant},
+			host:     []string{hostVariant},
+		},
+		{
+			name:     "32",
+			env:      envOf(),
+			multilib: "32",
+			device:   []string{deviceArmVariant},
+			host:     []string{hostX86Variant},
+		},
+		{
+			name:     "both",
+			env:      envOf(),
+			multilib: "both",
+			device:   []string{deviceArmVariant, deviceVariant},
+			host:     []string{hostX86Variant, hostVariant},
+		},
+		{
+			name:     "first",
+			env:      envOf(),
+			multilib: "first",
+			device:   []string{deviceVariant},
+			host:     []string{hostVariant},
+		},
+		{
+			name:     "prefer32",
+			env:      envOf(),
+			multilib: "prefer32",
+			device:   []string{deviceArmVariant},
+			host:     []string{hostX86Variant},
+		},
+		{
+			name:   "HOST_PREFER_32_BIT",
+			env:    envOf("HOST_PREFER_32_BIT", "true"),
+			device: []string{deviceVariant},
+			host:   []string{hostX86Variant},
+		},
+		{
+			name:   "ART_TARGET_PREFER_32_BIT",
+			env:    envOf("ART_TARGET_PREFER_32_BIT", "true"),
+			device: []string{deviceArmVariant},
+			host:   []string{hostVariant},
+		},
+		{
+			name:     "property over environment",
+			env:      envOf("HOST_PREFER_32_BIT", "true", "ART_TARGET_PREFER_32_BIT", "true"),
+			multilib: "64",
+			device:   []string{deviceVariant},
+			host:     []string{hostVariant},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			multilib := ""
+			if tc.multilib != "" {
+				multilib = fmt.Sprintf("art_compile_multilib: %q,", tc.multilib)
+			}
+			result := runArtTest(t, tc.env, fmt.Sprintf(`
+				art_cc_binary {
+					name: "foo",
+					defaults: ["art_defaults"],
+					host_supported: true,
+					srcs: ["foo.cc"],
+					%s
+				}
+			`, multilib))
+			android.AssertDeepEquals(t, "device variants", tc.device, variantsWithPrefix(result, "foo", "android_"))
+			android.AssertDeepEquals(t, "host variants", tc.host, variantsWithPrefix(result, "foo", "linux_glibc_"))
+		})
+	}
+
+	runArtErrorTest(t, `art_compile_multilib: unknown value "128"`, envOf(), `
+		art_cc_binary {
+			name: "foo",
+			srcs: ["foo.cc"],
+			art_compile_multilib: "128",
+		}
+	`)
+}
+
+// Fuzzers do not need the ART defaults. The fuzzing runtimes are not among the
+// default modules, so missing dependencies are allowed.
+func TestFuzz(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_fuzz {
+			name: "foo_fuzzer",
+			srcs: ["foo.cc"],
+		}
+	`, android.PrepareForTestWithAllowMissingDependencies)
+	android.AssertStringListContains(t, "variants", result.ModuleVariantsForTests("foo_fuzzer"), deviceVariant+"_fuzzer")
+}
+
+func TestAllowExceptions(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_test {
+			name: "art_exceptions_tests",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			gtest: false,
+			srcs: ["foo.cc"],
+			allow_exceptions: true,
+		}
+
+		art_cc_test {
+			name: "art_foo_tests",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			gtest: false,
+			srcs: ["foo.cc"],
+		}
+	`)
+	android.AssertBoolEquals(t, "flagged host", true,
+		hasFlag(cflagsOf(result, "art_exceptions_tests", hostVariant), "-fexceptions"))
+	android.AssertBoolEquals(t, "flagged device", false,
+		hasFlag(cflagsOf(result, "art_exceptions_tests", deviceVariant), "-fexceptions"))
+	android.AssertBoolEquals(t, "other host", false,
+		hasFlag(cflagsOf(result, "art_foo_tests", hostVariant), "-fexceptions"))
+}
+
+// A LoadHookContext for calling hooks directly. Only the methods that the hooks
+// under test use are implemented.
+type testLoadHookContext struct {
+	android.LoadHookContext
+	config   android.Config
+	appended []interface{}
+}
+
+func (ctx *testLoadHookContext) Config() android.Config {
+	return ctx.config
+}
+
+func (ctx *testLoadHookContext) AppendProperties(props ...interface{}) {
+	ctx.appended = append(ctx.appended, props...)
+}
+
+// Returns the strings in the field at the given path, e.g. Sanitize.Recover, of
+// the properties that were appended.
+func (ctx *testLoadHookContext) appendedStrings(path ...string) []string {
+	var ret []string
+	for _, props := range ctx.appended {
+		v := reflect.ValueOf(props).Elem()
+		for _, name := range path {
+			if v = v.FieldByName(name); !v.IsValid() {
+				break
+			}
+		}
+		if v.IsValid() {
+			ret = append(ret, v.Interface().([]string)...)
+		}
+	}
+	return ret
+}
+
+// The module recover list is merged with the one of the global defaults.
+func TestSanitizeRecover(t *testing.T) {
+	testCases := []struct {
+		name     string
+		tracking bool
+		recover  []string
+		want     []string
+	}{
+		{name: "tracking", tracking: true, recover: []string{"integer"}, want: []string{"address", "integer"}},
+		{name: "tracking with address", tracking: true, recover: []string{"address", "integer"}, want: []string{"address", "integer"}},
+		{name: "no tracking", recover: []string{"integer", "integer"}, want: []string{"integer"}},
+		{name: "none", tracking: true, want: []string{"address"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := map[string]string{}
+			if tc.tracking {
+				env["ART_DEX_FILE_ACCESS_TRACKING"] = "true"
+			}
+			ctx := &testLoadHookContext{config: android.TestConfig(t.TempDir(), env, "", nil)}
+			sanitizeRecover(ctx, &sanitizeRecoverProperties{Sanitize_recover: tc.recover})
+			got := append(globalSanitizeRecover(ctx), ctx.appendedStrings("Sanitize", "Recover")...)
+			android.AssertDeepEquals(t, "recover", tc.want, got)
+		})
+	}
+
+	// The global defaults only recover with access tracking.
+	device, _ := libfooCflags(t, envOf("ART_DEX_FILE_ACCESS_TRACKING", "true"))
+	android.AssertBoolEquals(t, "-DART_DEX_FILE_ACCESS_TRACKING", true, hasFlag(device, "-DART_DEX_FILE_ACCESS_TRACKING"))
+}
+
+// Two tests with suites and requirements, for the queries of the test map.
+const artTestsBp = `
+art_cc_test {
+	name: "art_foo_tests",
+	defaults: ["art_defaults"],
+	host_supported: true,
+	gtest: false,
+	srcs: ["foo.cc"],
+	art_test_suites: ["gcstress", "jit"],
+	art_test_requires: ["64bit", "sve"],
+}
+
+art_cc_test {
+	name: "art_bar_tests",
+	defaults: ["art_defaults"],
+	host_supported: true,
+	gtest: false,
+	srcs: ["bar.cc"],
+	art_test_suites: ["jit", "jit"],
+}
+`
+
+func TestArtTestMap(t *testing.T) {
+	result := runArtTest(t, envOf(), artTestsBp)
+	testMap := ArtTestMap(result.Config)
+	for _, name := range []string{
+		"device_arm64_art_foo_tests",
+		"device_arm_art_foo_tests",
+		"host_x86_64_art_foo_tests",
+		"host_x86_art_foo_tests",
+		"device_arm64_art_bar_tests",
+	} {
+		if len(testMap[name]) != 1 {
+			t.Errorf("expected one path for %s, got %q", name, testMap[name])
+		}
+	}
+
+	// The returned map is a copy.
+	testMap["device_arm64_art_foo_tests"] = nil
+	android.AssertIntEquals(t, "paths after modifying the copy", 1,
+		len(ArtTestMap(result.Config)["device_arm64_art_foo_tests"]))
+}
+
+func TestArtTestPaths(t *testing.T) {
+	result := runArtTest(t, envOf(), artTestsBp)
+
+	arm64 := ArtTestPaths(result.Config, false, "arm64")
+	android.AssertDeepEquals(t, "arm64 tests", []string{"art_bar_tests", "art_foo_tests"}, android.SortedKeys(arm64))
+	assertMatches(t, "arm64 path", arm64["art_foo_tests"][0], `/nativetest64/art_foo_tests/art_foo_tests$`)
+
+	// The x86_64 tests are not included for x86.
+	x86 := ArtTestPaths(result.Config, true, "x86")
+	android.AssertDeepEquals(t, "x86 tests", []string{"art_bar_tests", "art_foo_tests"}, android.SortedKeys(x86))
+	assertMatches(t, "x86 path", x86["art_foo_tests"][0], `/nativetest/art_foo_tests/art_foo_tests$`)
+}
+
+func TestArtTestSuites(t *testing.T) {
+	result := runArtTest(t, envOf(), artTestsBp)
+	android.AssertDeepEquals(t, "suites", map[string][]string{
+		"gcstress": {"art_foo_tests"},
+		"jit":      {"art_bar_tests", "art_foo_tests"},
+	}, ArtTestSuites(result.Config))
+
+	runArtErrorTest(t, "art_test_suites: suite names must not be empty", envOf(), `
+		art_cc_test {
+			name: "art_foo_tests",
+			gtest: false,
+			srcs: ["foo.cc"],
+			art_test_suites: [""],
+		}
+	`)
+}
+
+func TestArtTestRequirements(t *testing.T) {
+	result := runArtTest(t, envOf(), artTestsBp)
+	requirements := ArtTestRequirements(result.Config)
+	android.AssertDeepEquals(t, "arm64 requirements", []string{"64bit", "sve"}, requirements["device_arm64_art_foo_tests"])
+	android.AssertDeepEquals(t, "host requirements", []string{"64bit", "sve"}, requirements["host_x86_64_art_foo_tests"])
+	if _, ok := requirements["device_arm64_art_bar_tests"]; ok {
+		t.Errorf("expected no requirements for art_bar_tests, got %q", requirements["device_arm64_art_bar_tests"])
+	}
+}
+
+// Tests with the same name in different namespaces would overwrite each other
+// in the test runner.
+func TestDuplicateTests(t *testing.T) {
+	test := `
+		soong_namespace {}
+
+		art_cc_test {
+			name: "art_dup_tests",
+			defaults: ["art_defaults"],
+			gtest: false,
+			srcs: ["dup.cc"],
+		}
+	`
+	runArtErrorTest(t, `Conflicting tests for device_arm64_art_dup_tests in art/[ab] and art/[ab]`, envOf(), "",
+		android.PrepareForTestWithNamespace,
+		android.FixtureAddTextFile("art/a/Android.bp", test),
+		android.FixtureAddTextFile("art/b/Android.bp", test),
+		android.FixtureMergeMockFs(android.MockFS{
+			"art/a/dup.cc": nil,
+			"art/b/dup.cc": nil,
+		}))
+}
+
+func TestNeverAllow(t *testing.T) {
+	artFixture(envOf(), "", android.FixtureAddTextFile("frameworks/foo/Android.bp", `
+		art_cc_library {
+			name: "libfoo",
+		}
+	`)).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		regexp.QuoteMeta("art_* module types are internal to ART, use the corresponding cc_* module types"))).
+		RunTest(t)
+}
+
+func TestSupportedArches(t *testing.T) {
+	arches := SupportedArches()
+	android.AssertDeepEquals(t, "arches", []string{"arm", "arm64", "riscv64", "x86", "x86_64"}, arches)
+
+	arches[0] = "mips"
+	android.AssertStringEquals(t, "first arch after modifying the copy", "arm", SupportedArches()[0])
+}
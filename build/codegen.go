@@ -22,20 +22,24 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/google/blueprint/proptools"
+
 	"android/soong/android"
 )
 
 type moduleType struct {
-	library bool
-	static  bool
-	shared  bool
+	library  bool
+	static   bool
+	shared   bool
+	hostOnly bool
 }
 
 var (
-	staticLibrary          = moduleType{true, true, false}
-	sharedLibrary          = moduleType{true, false, true}
-	staticAndSharedLibrary = moduleType{true, true, true}
-	binary                 = moduleType{false, false, false}
+	staticLibrary              = moduleType{true, true, false, false}
+	sharedLibrary              = moduleType{true, false, true, false}
+	staticAndSharedLibrary     = moduleType{true, true, true, false}
+	hostStaticAndSharedLibrary = moduleType{true, true, true, true}
+	binary                     = moduleType{false, false, false, false}
 )
 
 func codegen(ctx android.LoadHookContext, c *codegenProperties, t moduleType) {
@@ -43,7 +47,7 @@ func codegen(ctx android.LoadHookContext, c *codegenProperties, t moduleType) {
 
 	e := ctx.Config().Getenv("ART_HOST_CODEGEN_ARCHS")
 	if e == "" {
-		hostArches = supportedArches
+		hostArches = SupportedArches()
 	} else {
 		hostArches = strings.Split(e, " ")
 	}
@@ -55,6 +59,21 @@ func codegen(ctx android.LoadHookContext, c *codegenProperties, t moduleType) {
 		deviceArches = strings.Split(e, " ")
 	}
 
+	// Interpreter-only builds do not include any optimizing compiler backend.
+	if ctx.Config().IsEnvTrue("ART_INTERPRETER_ONLY") {
+		hostArches = nil
+		deviceArches = nil
+	}
+
+	for _, arch := range c.Codegen_exclude_arches {
+		if !android.InList(arch, SupportedArches()) {
+			ctx.PropertyErrorf("codegen_exclude_arches", "unknown arch %q, expected one of %s",
+				arch, strings.Join(SupportedArches(), ", "))
+		}
+	}
+	hostArches = android.RemoveListFromList(hostArches, c.Codegen_exclude_arches)
+	deviceArches = android.RemoveListFromList(deviceArches, c.Codegen_exclude_arches)
+
 	getCodegenArchProperties := func(archName string) *codegenArchProperties {
 		var arch *codegenArchProperties
 		switch archName {
@@ -165,8 +184,63 @@ func codegen(ctx android.LoadHookContext, c *codegenProperties, t moduleType) {
 		addCodegenSourceArchProperties(host, sourceProps)
 	}
 
-	addCodegenProperties(false /* host */, deviceArches)
+	if !t.hostOnly {
+		addCodegenProperties(false /* host */, deviceArches)
+	}
 	addCodegenProperties(true /* host */, hostArches)
+
+	addXclangFlags(ctx, c)
+	addRpassFlags(ctx, c)
+
+	if proptools.Bool(c.Aggressive_opt) {
+		type props struct {
+			Target struct {
+				Android struct {
+					Cflags []string
+				}
+				Host struct {
+					Cflags []string
+				}
+			}
+		}
+
+		// Use the target cflags, so that this comes after the per-target
+		// overrides of ART_NDEBUG_OPT_FLAG in the defaults.
+		p := &props{}
+		p.Target.Android.Cflags = []string{"-O3", "-funroll-loops"}
+		p.Target.Host.Cflags = []string{"-O3", "-funroll-loops"}
+		ctx.AppendProperties(p)
+	}
+}
+
+// Expands the rpass_filters property into optimization remark flags in the module cflags.
+func addRpassFlags(ctx android.LoadHookContext, c *codegenProperties) {
+	type props struct {
+		Cflags []string
+	}
+
+	p := &props{}
+	for _, filter := range c.Rpass_filters {
+		p.Cflags = append(p.Cflags, "-Rpass="+filter, "-Rpass-missed="+filter)
+	}
+	ctx.AppendProperties(p)
+}
+
+// Expands the xclang_flags property into "-Xclang <flag>" pairs in the module cflags.
+func addXclangFlags(ctx android.LoadHookContext, c *codegenProperties) {
+	type props struct {
+		Cflags []string
+	}
+
+	p := &props{}
+	for _, flag := range c.Xclang_flags {
+		if strings.TrimSpace(flag) == "" {
+			ctx.PropertyErrorf("xclang_flags", "flags must not be empty")
+			continue
+		}
+		p.Cflags = append(p.Cflags, "-Xclang", flag)
+	}
+	ctx.AppendProperties(p)
 }
 
 // These properties are allowed to contain the same source file name in different architectures.
@@ -209,6 +283,21 @@ type codegenProperties struct {
 	Codegen struct {
 		Arm, Arm64, Riscv64, X86, X86_64 codegenArchProperties
 	}
+
+	// Experimental clang frontend flags, each passed to this module as -Xclang <flag>.
+	Xclang_flags []string
+
+	// Optimization passes to report remarks for in this module, e.g. loop-vectorize.
+	// Each filter is passed to -Rpass and -Rpass-missed.
+	Rpass_filters []string
+
+	// Compile this module with -O3 and loop unrolling, regardless of the global
+	// optimization flag. Reserved for hot code, since it increases code size.
+	Aggressive_opt *bool
+
+	// Arches whose codegen is left out of this module, e.g. during the bring-up
+	// of a backend. The rest of the module is still built for them.
+	Codegen_exclude_arches []string
 }
 
 func defaultDeviceCodegenArches(ctx android.LoadHookContext) []string {
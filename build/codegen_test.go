@@ -0,0 +1,182 @@
+// Copyright (C) 2023 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package art
+
+import (
+	"strings"
+	"testing"
+
+	"android/soong/android"
+)
+
+// A library with codegen sources and flags for arm64 and riscv64.
+const libcodegenBp = `
+art_cc_library {
+	name: "libcodegen",
+	defaults: ["art_defaults"],
+	host_supported: true,
+	srcs: ["foo.cc"],
+	codegen: {
+		arm64: {
+			srcs: ["codegen_arm64.cc"],
+			cflags: ["-DCODEGEN_ARM64"],
+		},
+		riscv64: {
+			srcs: ["codegen_riscv64.cc"],
+			cflags: ["-DCODEGEN_RISCV64"],
+		},
+	},
+}
+`
+
+// Returns whether the given module variant has an object file for src.
+func hasObject(result *android.TestResult, module, variant, src string) bool {
+	for _, output := range result.ModuleForTests(module, variant).AllOutputs() {
+		if strings.HasSuffix(output, "/"+strings.TrimSuffix(src, ".cc")+".o") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCodegen(t *testing.T) {
+	result := runArtTest(t, envOf(), libcodegenBp)
+
+	// The device only builds the codegen of its own arches, the host all of them.
+	device := cflagsOf(result, "libcodegen", deviceLibVariant)
+	android.AssertBoolEquals(t, "device arm64", true, hasFlag(device, "-DCODEGEN_ARM64"))
+	android.AssertBoolEquals(t, "device riscv64", false, hasFlag(device, "-DCODEGEN_RISCV64"))
+	android.AssertBoolEquals(t, "device arm64 object", true,
+		hasObject(result, "libcodegen", deviceLibVariant, "codegen_arm64.cc"))
+
+	host := cflagsOf(result, "libcodegen", hostLibVariant)
+	android.AssertBoolEquals(t, "host arm64", true, hasFlag(host, "-DCODEGEN_ARM64"))
+	android.AssertBoolEquals(t, "host riscv64", true, hasFlag(host, "-DCODEGEN_RISCV64"))
+	android.AssertBoolEquals(t, "host riscv64 object", true,
+		hasObject(result, "libcodegen", hostLibVariant, "codegen_riscv64.cc"))
+}
+
+func TestInterpreterOnly(t *testing.T) {
+	result := runArtTest(t, envOf("ART_INTERPRETER_ONLY", "true"), libcodegenBp)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		cflags := cflagsOf(result, "libcodegen", variant)
+		android.AssertBoolEquals(t, variant+" -DART_INTERPRETER_ONLY=1", true, hasFlag(cflags, "-DART_INTERPRETER_ONLY=1"))
+		android.AssertBoolEquals(t, variant+" codegen cflags", false, hasFlag(cflags, "-DCODEGEN_ARM64"))
+		android.AssertBoolEquals(t, variant+" codegen object", false,
+			hasObject(result, "libcodegen", variant, "codegen_arm64.cc"))
+		android.AssertBoolEquals(t, variant+" other object", true, hasObject(result, "libcodegen", variant, "foo.cc"))
+	}
+
+	device, _ := libfooCflags(t, envOf())
+	android.AssertBoolEquals(t, "-DART_INTERPRETER_ONLY=1 by default", false, hasFlag(device, "-DART_INTERPRETER_ONLY=1"))
+}
+
+func TestCodegenExcludeArches(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_library {
+			name: "libcodegen",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+			codegen_exclude_arches: ["riscv64"],
+			codegen: {
+				arm64: {
+					srcs: ["codegen_arm64.cc"],
+					cflags: ["-DCODEGEN_ARM64"],
+				},
+				riscv64: {
+					srcs: ["codegen_riscv64.cc"],
+					cflags: ["-DCODEGEN_RISCV64"],
+				},
+			},
+		}
+	`)
+	host := cflagsOf(result, "libcodegen", hostLibVariant)
+	android.AssertBoolEquals(t, "host arm64", true, hasFlag(host, "-DCODEGEN_ARM64"))
+	android.AssertBoolEquals(t, "host riscv64", false, hasFlag(host, "-DCODEGEN_RISCV64"))
+	android.AssertBoolEquals(t, "host riscv64 object", false,
+		hasObject(result, "libcodegen", hostLibVariant, "codegen_riscv64.cc"))
+
+	runArtErrorTest(t, `codegen_exclude_arches: unknown arch "mips"`, envOf(), `
+		art_cc_library {
+			name: "libcodegen",
+			srcs: ["foo.cc"],
+			codegen_exclude_arches: ["mips"],
+		}
+	`)
+}
+
+func TestXclangFlags(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_library {
+			name: "libxclang",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+			xclang_flags: ["-fno-pch-timestamp", "-disable-llvm-verifier"],
+		}
+	`+libfooBp)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		android.AssertStringDoesContain(t, variant+" cflags", cflagsOf(result, "libxclang", variant),
+			"-Xclang -fno-pch-timestamp -Xclang -disable-llvm-verifier")
+		android.AssertStringDoesNotContain(t, variant+" libfoo cflags", cflagsOf(result, "libfoo", variant), "-Xclang")
+	}
+
+	runArtErrorTest(t, "xclang_flags: flags must not be empty", envOf(), `
+		art_cc_library {
+			name: "libxclang",
+			srcs: ["foo.cc"],
+			xclang_flags: [" "],
+		}
+	`)
+}
+
+func TestRpassFilters(t *testing.T) {
+	result := runArtTest(t, envOf(), `
+		art_cc_library {
+			name: "librpass",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+			rpass_filters: ["loop-vectorize", "inline"],
+		}
+	`)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		android.AssertStringDoesContain(t, variant+" cflags", cflagsOf(result, "librpass", variant),
+			"-Rpass=loop-vectorize -Rpass-missed=loop-vectorize -Rpass=inline -Rpass-missed=inline")
+	}
+}
+
+// aggressive_opt must win over the per-target optimization flags of the
+// defaults.
+func TestAggressiveOpt(t *testing.T) {
+	result := runArtTest(t, envOf("ART_NDEBUG_OPT_FLAG_DEVICE", "-Os", "ART_NDEBUG_OPT_FLAG_HOST", "-O2"), libfooBp+`
+		art_cc_library {
+			name: "libhot",
+			defaults: ["art_defaults"],
+			host_supported: true,
+			srcs: ["foo.cc"],
+			aggressive_opt: true,
+		}
+	`)
+	for _, variant := range []string{deviceLibVariant, hostLibVariant} {
+		hot := cflagsOf(result, "libhot", variant)
+		android.AssertStringEquals(t, variant+" libhot", "-O3", lastOptFlag(hot))
+		android.AssertBoolEquals(t, variant+" libhot -funroll-loops", true, hasFlag(hot, "-funroll-loops"))
+		android.AssertBoolEquals(t, variant+" libfoo -funroll-loops", false,
+			hasFlag(cflagsOf(result, "libfoo", variant), "-funroll-loops"))
+	}
+	android.AssertStringEquals(t, "libfoo device", "-Os", lastOptFlag(cflagsOf(result, "libfoo", deviceLibVariant)))
+}
@@ -0,0 +1,256 @@
+// Copyright (C) 2023 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package art
+
+// This file keeps track of the environment variables that affect the flags of ART modules, and
+// implements the files that report them and the resulting configuration to build telemetry,
+// remote execution and CI.
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"android/soong/android"
+)
+
+type artEnvVar struct {
+	name string
+	// Value that is used when the variable is unset.
+	def string
+}
+
+// Environment variables that affect the global flags of ART modules. Keep this list, or
+// artLocalEnvVars below, up to date when reading a new variable in this package.
+var artEnvVars = []artEnvVar{
+	{"ART_ARM64_FEATURES", ""},
+	{"ART_ARM_FEATURES", ""},
+	{"ART_BUILD_PROFILE", ""},
+	{"ART_CLANG_PREBUILT_OS", ""},
+	{"ART_DEFAULT_COMPACT_DEX_LEVEL", "fast"},
+	{"ART_DEFAULT_GC_TYPE", "CMC"},
+	{"ART_DEFAULT_ISA_FEATURES", ""},
+	{"ART_DEFAULT_VERIFY_LEVEL", ""},
+	{"ART_DEVICE_BRANCH_PROTECTION", "off"},
+	{"ART_DEVICE_CF_PROTECTION", "off"},
+	{"ART_DEVICE_FRAME_SIZE_LIMIT", ""},
+	{"ART_DEVICE_FRAME_SIZE_LIMIT_address", ""},
+	{"ART_DEVICE_FRAME_SIZE_LIMIT_hwaddress", ""},
+	{"ART_DEVICE_FRAME_SIZE_LIMIT_integer_overflow", ""},
+	{"ART_DEVICE_FRAME_SIZE_LIMIT_thread", ""},
+	{"ART_DEVICE_FRAME_SIZE_LIMIT_undefined", ""},
+	{"ART_DEVICE_KEEP_NULL_CHECKS", ""},
+	{"ART_DEVICE_LINKER_SCRIPT", ""},
+	{"ART_DEX_FILE_ACCESS_TRACKING", ""},
+	{"ART_ENABLE_ADDRESS_SANITIZER", ""},
+	{"ART_ENABLE_LTO", ""},
+	{"ART_EXTRA_ASFLAGS", ""},
+	{"ART_EXTRA_CFLAGS", ""},
+	{"ART_EXTRA_SANITIZERS", ""},
+	{"ART_EXTRA_SANITIZERS_VARIANT", "both"},
+	{"ART_FORCE_ASSERTS", ""},
+	{"ART_FRAME_SIZE_ERROR", ""},
+	{"ART_GC_THREAD_COUNT", ""},
+	{"ART_HEAP_POISONING", ""},
+	{"ART_HOST_CODEGEN_ARCHS", ""},
+	{"ART_HOST_DEFAULT_BOOT_IMAGE_LOCATION", "apex/art_boot_images/javalib/boot.art"},
+	{"ART_HOST_EXTRA_DEFINES", ""},
+	{"ART_HOST_FRAME_SIZE_LIMIT", ""},
+	{"ART_IMPLICIT_NULL_CHECKS_arm", ""},
+	{"ART_IMPLICIT_NULL_CHECKS_arm64", ""},
+	{"ART_IMPLICIT_NULL_CHECKS_riscv64", ""},
+	{"ART_IMPLICIT_NULL_CHECKS_x86", ""},
+	{"ART_IMPLICIT_NULL_CHECKS_x86_64", ""},
+	{"ART_INLINE_THRESHOLD", ""},
+	{"ART_INTERPRETER_ONLY", ""},
+	{"ART_KEEP_FRAME_POINTERS", ""},
+	{"ART_LARGE_OBJECT_THRESHOLD", ""},
+	{"ART_LTO_FULL", ""},
+	{"ART_NATIVE_ALLOCATOR", ""},
+	{"ART_NDEBUG_OPT_FLAG", "-O3"},
+	{"ART_NDEBUG_OPT_FLAG_DEVICE", ""},
+	{"ART_NDEBUG_OPT_FLAG_HOST", ""},
+	{"ART_PGO_INSTRUMENT", ""},
+	{"ART_PGO_PROFILE", ""},
+	{"ART_READ_BARRIER_TYPE", "BAKER"},
+	{"ART_RISCV64_FEATURES", ""},
+	{"ART_SANITIZE_COVERAGE", ""},
+	{"ART_SIMULATOR_TARGET_ISA", "arm64"},
+	{"ART_STACK_OVERFLOW_GAP_arm", ""},
+	{"ART_STACK_OVERFLOW_GAP_arm64", ""},
+	{"ART_STACK_OVERFLOW_GAP_riscv64", ""},
+	{"ART_STACK_OVERFLOW_GAP_x86", ""},
+	{"ART_STACK_OVERFLOW_GAP_x86_64", ""},
+	{"ART_STRIP_COMMENT", ""},
+	{"ART_TARGET_CODEGEN_ARCHS", ""},
+	{"ART_TARGET_DEFAULT_BOOT_IMAGE_LOCATION", "/apex/com.android.art/javalib/boot.art"},
+	{"ART_TARGET_LINUX", ""},
+	{"ART_TARGET_OS", "android"},
+	{"ART_TEST_DEBUG_GC", ""},
+	{"ART_USE_CXX_INTERPRETER", ""},
+	{"ART_USE_D8_DESUGAR", ""},
+	{"ART_USE_D8_DESUGAR_arm", ""},
+	{"ART_USE_D8_DESUGAR_arm64", ""},
+	{"ART_USE_D8_DESUGAR_riscv64", ""},
+	{"ART_USE_D8_DESUGAR_x86", ""},
+	{"ART_USE_D8_DESUGAR_x86_64", ""},
+	{"ART_USE_GENERATIONAL_CC", ""},
+	{"ART_USE_GENERATIONAL_GC", ""},
+	{"ART_USE_READ_BARRIER", ""},
+	{"ART_USE_SIMULATOR", ""},
+	{"ART_WERROR_LIST", ""},
+	{"ART_X86_64_FEATURES", ""},
+	{"ART_X86_FEATURES", ""},
+	{"CUSTOM_TARGET_LINKER", ""},
+	{"LIBART_IMG_HOST_MAX_BASE_ADDRESS_DELTA", "0x1000000"},
+	{"LIBART_IMG_HOST_MIN_BASE_ADDRESS_DELTA", "(-0x1000000)"},
+	{"LIBART_IMG_TARGET_MAX_BASE_ADDRESS_DELTA", "0x1000000"},
+	{"LIBART_IMG_TARGET_MIN_BASE_ADDRESS_DELTA", "(-0x1000000)"},
+	{"USE_D8_DESUGAR", ""},
+}
+
+// Environment variables that are read in this package, but only affect the flags of the modules
+// they list, select which variants are built, or validate the configuration. They are reported
+// with artEnvVars, but are not part of artEnvHash.
+var artLocalEnvVars = []artEnvVar{
+	{"ART_EMIT_ENV_TELEMETRY", ""},
+	{"ART_EMIT_STACK_USAGE", ""},
+	{"ART_HOST_ONLY", ""},
+	{"ART_O0_MODULES", ""},
+	{"ART_PGO_PROFILE_DIR", ""},
+	{"ART_REQUIRED_ENV", ""},
+	{"ART_STRICT_CUSTOM_LINKER", ""},
+	{"ART_TARGET_PREFER_32_BIT", ""},
+	{"HOST_PREFER_32_BIT", ""},
+}
+
+// Returns all registered environment variables, sorted by name.
+func allArtEnvVars() []artEnvVar {
+	vars := append(append([]artEnvVar(nil), artEnvVars...), artLocalEnvVars...)
+	sort.Slice(vars, func(i, j int) bool { return vars[i].name < vars[j].name })
+	return vars
+}
+
+// Returns the resolved values of the given environment variables, keyed by name.
+func resolvedArtEnv(config android.Config, vars []artEnvVar) map[string]string {
+	env := make(map[string]string, len(vars))
+	for _, v := range vars {
+		env[v.name] = config.GetenvWithDefault(v.name, v.def)
+	}
+	return env
+}
+
+// Returns a hash of the resolved values of the environment variables in artEnvVars. Builds with
+// the same global flag-affecting configuration get the same hash.
+func artEnvHash(config android.Config) string {
+	env := resolvedArtEnv(config, artEnvVars)
+	h := fnv.New64a()
+	for _, name := range android.SortedKeys(env) {
+		fmt.Fprintf(h, "%s=%s\n", name, env[name])
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func init() {
+	registerArtEnvSingletons(android.InitRegistrationContext)
+}
+
+func registerArtEnvSingletons(ctx android.RegistrationContext) {
+	ctx.RegisterSingletonType("art_env_telemetry", envTelemetrySingletonFactory)
+	ctx.RegisterSingletonType("art_env_inputs", envInputsSingletonFactory)
+	ctx.RegisterSingletonType("art_build_config", buildConfigSingletonFactory)
+}
+
+func envTelemetrySingletonFactory() android.Singleton {
+	return &envTelemetrySingleton{}
+}
+
+// Writes the resolved values of the registered environment variables to
+// $OUT/soong/art_env_telemetry.txt when ART_EMIT_ENV_TELEMETRY is true.
+type envTelemetrySingleton struct{}
+
+func (s *envTelemetrySingleton) GenerateBuildActions(ctx android.SingletonContext) {
+	if !ctx.Config().IsEnvTrue("ART_EMIT_ENV_TELEMETRY") {
+		return
+	}
+
+	env := resolvedArtEnv(ctx.Config(), allArtEnvVars())
+	var lines []string
+	for _, name := range android.SortedKeys(env) {
+		lines = append(lines, name+"="+env[name])
+	}
+
+	out := android.PathForOutput(ctx, "art_env_telemetry.txt")
+	android.WriteFileRule(ctx, out, strings.Join(lines, "\n"))
+}
+
+func envInputsSingletonFactory() android.Singleton {
+	return &envInputsSingleton{}
+}
+
+type envInput struct {
+	Name string `json:"name"`
+	Set  bool   `json:"set"`
+}
+
+// Writes $OUT/soong/art_env_inputs.json, which lists the registered environment
+// variables and whether they are set. Remote execution uses it to key caches on
+// all flag-affecting inputs, including unset variables that select defaults.
+type envInputsSingleton struct{}
+
+func (s *envInputsSingleton) GenerateBuildActions(ctx android.SingletonContext) {
+	vars := allArtEnvVars()
+	inputs := make([]envInput, 0, len(vars))
+	for _, v := range vars {
+		inputs = append(inputs, envInput{Name: v.name, Set: ctx.Config().Getenv(v.name) != ""})
+	}
+
+	content, err := json.MarshalIndent(inputs, "", "  ")
+	if err != nil {
+		ctx.Errorf("Failed to marshal ART environment inputs: %s", err)
+		return
+	}
+
+	out := android.PathForOutput(ctx, "art_env_inputs.json")
+	android.WriteFileRule(ctx, out, string(content))
+}
+
+func buildConfigSingletonFactory() android.Singleton {
+	return &buildConfigSingleton{}
+}
+
+// Writes the ArtConfig resolved by the global defaults to
+// $OUT/soong/art_build_config.json, so that CI can compare the GC, read barrier,
+// sanitizer and optimization settings of different builds.
+type buildConfigSingleton struct{}
+
+func (s *buildConfigSingleton) GenerateBuildActions(ctx android.SingletonContext) {
+	c, ok := ctx.Config().Once(buildConfigKey, func() interface{} { return nil }).(ArtConfig)
+	if !ok {
+		// No module uses the ART global defaults.
+		return
+	}
+
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		ctx.Errorf("Failed to marshal ART build config: %s", err)
+		return
+	}
+
+	out := android.PathForOutput(ctx, "art_build_config.json")
+	android.WriteFileRule(ctx, out, string(content))
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2023 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package art
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+)
+
+// Returns the content of the file that the given singleton writes with
+// WriteFileRule, or "" if it does not write it.
+func singletonFileContent(t *testing.T, result *android.TestResult, singleton, file string) string {
+	t.Helper()
+	params := result.SingletonForTests(singleton).MaybeOutput(file)
+	if params.Rule == nil {
+		return ""
+	}
+	return android.ContentFromFileRuleForTests(t, params)
+}
+
+func TestEnvTelemetry(t *testing.T) {
+	result := runArtTest(t, envOf("ART_EMIT_ENV_TELEMETRY", "true", "ART_HEAP_POISONING", "true"), "")
+	content := singletonFileContent(t, result, "art_env_telemetry", "art_env_telemetry.txt")
+	lines := strings.Split(content, "\n")
+	for _, line := range []string{
+		"ART_DEFAULT_GC_TYPE=CMC",
+		"ART_HEAP_POISONING=true",
+		"ART_EMIT_ENV_TELEMETRY=true",
+		"ART_USE_READ_BARRIER=",
+	} {
+		android.AssertStringListContains(t, "lines", lines, line)
+	}
+	android.AssertIntEquals(t, "lines", len(allArtEnvVars()), len(lines))
+	android.AssertBoolEquals(t, "sorted", true, sort.StringsAreSorted(lines))
+
+	result = runArtTest(t, envOf(), "")
+	android.AssertStringEquals(t, "content without ART_EMIT_ENV_TELEMETRY", "",
+		singletonFileContent(t, result, "art_env_telemetry", "art_env_telemetry.txt"))
+}
+
+func TestEnvInputs(t *testing.T) {
+	result := runArtTest(t, envOf("ART_HEAP_POISONING", "true", "ART_INTERPRETER_ONLY", "false"), "")
+	var inputs []envInput
+	content := singletonFileContent(t, result, "art_env_inputs", "art_env_inputs.json")
+	if err := json.Unmarshal([]byte(content), &inputs); err != nil {
+		t.Fatalf("failed to parse art_env_inputs.json: %s\n%s", err, content)
+	}
+
+	var names, set []string
+	for _, input := range inputs {
+		names = append(names, input.Name)
+		if input.Set {
+			set = append(set, input.Name)
+		}
+	}
+	var want []string
+	for _, v := range allArtEnvVars() {
+		want = append(want, v.name)
+	}
+	android.AssertDeepEquals(t, "names", want, names)
+	android.AssertDeepEquals(t, "set", []string{"ART_HEAP_POISONING", "ART_INTERPRETER_ONLY"}, set)
+}
+
+func TestBuildConfigJson(t *testing.T) {
+	result := runArtTest(t, envOf("ART_DEFAULT_GC_TYPE", "CMS"), "",
+		prepareForSanitizers([]string{"hwaddress"}, nil))
+	content := singletonFileContent(t, result, "art_build_config", "art_build_config.json")
+
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &config); err != nil {
+		t.Fatalf("failed to parse art_build_config.json: %s\n%s", err, content)
+	}
+	android.AssertDeepEquals(t, "gc_type", "CMS", config["gc_type"])
+	android.AssertDeepEquals(t, "read_barrier", false, config["read_barrier"])
+	android.AssertDeepEquals(t, "device_sanitizers", []interface{}{"hwaddress"}, config["device_sanitizers"])
+	android.AssertDeepEquals(t, "opt_flag", "-O3", config["opt_flag"])
+	android.AssertDeepEquals(t, "config_hash", artEnvHash(result.Config), config["config_hash"])
+
+	// GENCMC is only marked as generational by a placeholder define.
+	result = runArtTest(t, envOf("ART_DEFAULT_GC_TYPE", "GENCMC"), "")
+	content = singletonFileContent(t, result, "art_build_config", "art_build_config.json")
+	config = nil
+	if err := json.Unmarshal([]byte(content), &config); err != nil {
+		t.Fatalf("failed to parse art_build_config.json: %s\n%s", err, content)
+	}
+	android.AssertDeepEquals(t, "generational", false, config["generational"])
+	android.AssertDeepEquals(t, "generational_cmc_placeholder", true, config["generational_cmc_placeholder"])
+
+	// Without the ART global defaults there is no configuration to write.
+	result = prepareForArtTest.RunTest(t)
+	android.AssertStringEquals(t, "content without art_defaults", "",
+		singletonFileContent(t, result, "art_build_config", "art_build_config.json"))
+}
+
+func TestArtEnvHash(t *testing.T) {
+	hash := func(env map[string]string) string {
+		return artEnvHash(android.TestConfig(t.TempDir(), env, "", nil))
+	}
+	base := hash(nil)
+
+	android.AssertStringEquals(t, "unrelated variable", base, hash(map[string]string{"FOO": "bar"}))
+	android.AssertStringEquals(t, "local variable", base, hash(map[string]string{"ART_O0_MODULES": "libart"}))
+	android.AssertStringEquals(t, "default value", base, hash(map[string]string{"ART_DEFAULT_GC_TYPE": "CMC"}))
+	if base == hash(map[string]string{"ART_DEFAULT_GC_TYPE": "CMS"}) {
+		t.Errorf("expected ART_DEFAULT_GC_TYPE=CMS to change the hash %s", base)
+	}
+	if base == hash(map[string]string{"ART_HEAP_POISONING": "true"}) {
+		t.Errorf("expected ART_HEAP_POISONING=true to change the hash %s", base)
+	}
+	assertMatches(t, "hash", base, `^[0-9a-f]{16}$`)
+}
+
+// The per-arch and per-sanitizer variables must all be registered, and each
+// variable only once.
+func TestArtEnvVarsRegistry(t *testing.T) {
+	global := make(map[string]bool)
+	for _, v := range artEnvVars {
+		global[v.name] = true
+	}
+	for _, arch := range SupportedArches() {
+		for _, prefix := range []string{"ART_IMPLICIT_NULL_CHECKS_", "ART_STACK_OVERFLOW_GAP_", "ART_USE_D8_DESUGAR_"} {
+			android.AssertBoolEquals(t, prefix+arch, true, global[prefix+arch])
+		}
+	}
+	for arch := range supportedIsaFeatures {
+		name := "ART_" + strings.ToUpper(arch) + "_FEATURES"
+		android.AssertBoolEquals(t, name, true, global[name])
+	}
+	for _, sanitizer := range supportedExtraSanitizers {
+		name := "ART_DEVICE_FRAME_SIZE_LIMIT_" + sanitizer
+		android.AssertBoolEquals(t, name, true, global[name])
+	}
+	for _, v := range artLocalEnvVars {
+		android.AssertBoolEquals(t, v.name+" in artEnvVars", false, global[v.name])
+	}
+
+	var names []string
+	for _, v := range allArtEnvVars() {
+		names = append(names, v.name)
+	}
+	android.AssertBoolEquals(t, "sorted", true, sort.StringsAreSorted(names))
+	android.AssertDeepEquals(t, "unique", android.FirstUniqueStrings(names), names)
+}
@@ -20,7 +20,6 @@ import (
 	"strings"
 
 	"android/soong/android"
-	"android/soong/cc/config"
 )
 
 var (
@@ -63,12 +62,12 @@ func makeVarsProvider(ctx android.MakeVarsContext) {
 	testcasesContent := testcasesContent(ctx.Config())
 	copy_cmds := []string{}
 	for _, key := range android.SortedKeys(testcasesContent) {
-		copy_cmds = append(copy_cmds, testcasesContent[key]+":"+key)
+		copy_cmds = append(copy_cmds, testcasesContent[key].Src+":"+key)
 	}
 	ctx.Strict("ART_TESTCASES_CONTENT", strings.Join(copy_cmds, " "))
 
 	// Add prebuilt tools.
-	clang_path := filepath.Join(config.ClangDefaultBase, ctx.Config().PrebuiltOS(), config.ClangDefaultVersion)
+	clang_path := artClangPath(ctx.Config())
 	copy_cmds = []string{}
 	for _, tool := range prebuiltToolsForTests {
 		src := filepath.Join(clang_path, "/", tool)